@@ -3,6 +3,7 @@ module bst-auth
 go 1.24.4
 
 require (
+	github.com/andybalholm/brotli v1.2.0
 	github.com/expr-lang/expr v1.17.6
 	github.com/higress-group/proxy-wasm-go-sdk v0.0.0-20250611100342-5654e89a7a80
 	github.com/higress-group/wasm-go v1.0.2-0.20250814044954-1399396aa906
@@ -3,12 +3,15 @@ package main
 import (
 	"bst-auth/pkg/config"
 	"bst-auth/pkg/retry"
+	"bst-auth/pkg/scheduler"
 	"bst-auth/pkg/token"
+	"strconv"
 
 	"github.com/higress-group/proxy-wasm-go-sdk/proxywasm"
 	"github.com/higress-group/proxy-wasm-go-sdk/proxywasm/types"
 	"github.com/higress-group/wasm-go/pkg/log"
 	"github.com/higress-group/wasm-go/pkg/wrapper"
+	"github.com/tidwall/gjson"
 )
 
 func main() {}
@@ -18,14 +21,37 @@ const (
 )
 
 func init() {
-	wrapper.SetCtx(
+	// 记录每个请求的 HTTP 上下文 ID，tick 和其他请求的回调中据此切换到暂停的请求；
+	// 缓存中的响应体超过 max_inspect_body_size 时放弃检查
+	proxywasm.SetVMContext(token.LimitResponseBody(token.TrackContextIDs(wrapper.NewCommonVmCtx(
 		"token-server",
-		wrapper.ParseConfig(config.ParseConfig),
+		wrapper.ParseConfig(parseConfig),
 		wrapper.ProcessRequestHeaders(onHttpRequestHeaders),
 		wrapper.ProcessRequestBody(onHttpRequestBody),
 		wrapper.ProcessResponseHeaders(onHttpResponseHeaders),
 		wrapper.ProcessResponseBody(onHttpResponseBody), //
-	)
+	))))
+}
+
+func parseConfig(json gjson.Result, cfg *config.SimpleConfig) error {
+	if err := config.ParseConfig(json, cfg); err != nil {
+		return err
+	}
+	if cfg.TokenConfig.Enabled {
+		// 插件启动时创建共享数据中的键，之后各 VM 只用 CAS 更新
+		token.GetTokenManager(*cfg).SeedSharedData()
+		// 周期检查 token 是否即将过期，提前刷新
+		wrapper.RegisteTickFunc(token.RefreshTickPeriod, func() {
+			token.GetTokenManager(*cfg).RefreshIfNeeded(*cfg)
+		})
+		// 处理等待 token 的请求：轮询其他 worker VM 刷新到共享数据中的 token，回收超时的 token 请求
+		wrapper.RegisteTickFunc(token.WaitTickPeriod, func() {
+			token.GetTokenManager(*cfg).ProcessWaiters()
+		})
+		// 执行到期的延迟任务，如 token 请求的退避重试
+		wrapper.RegisteTickFunc(scheduler.TickPeriod, scheduler.RunDue)
+	}
+	return nil
 }
 
 func onHttpRequestHeaders(ctx wrapper.HttpContext, config config.SimpleConfig) types.Action {
@@ -44,7 +70,15 @@ func onHttpRequestHeaders(ctx wrapper.HttpContext, config config.SimpleConfig) t
 	// 初始化重试上下文
 	retry.InitializeRetryContext(ctx, headers, config)
 
-	return token.GetTokenManager().FetchToken(config)
+	// wrapper 不会把带 content-encoding 的响应体交给插件，条件需要响应体时要求上游不压缩首次响应
+	// 重放请求仍使用原始请求头，压缩的重放响应由插件解码后检查
+	if token.InvalidConditionNeedsBody(config.TokenConfig) {
+		if err := proxywasm.ReplaceHttpRequestHeader("accept-encoding", "identity"); err != nil {
+			log.Warnf("Failed to replace accept-encoding: %v", err)
+		}
+	}
+
+	return token.GetTokenManager(config).FetchToken(ctx, config)
 }
 
 func onHttpRequestBody(ctx wrapper.HttpContext, config config.SimpleConfig, body []byte) types.Action {
@@ -55,6 +89,11 @@ func onHttpRequestBody(ctx wrapper.HttpContext, config config.SimpleConfig, body
 
 	retry.SetOriginalBody(ctx, body)
 
+	// 请求头阶段只能注入请求头，表单等请求体中的注入在这里完成
+	if usedToken, ok := ctx.GetContext(token.UsedTokenKey).(string); ok {
+		token.GetTokenManager(config).InjectTokenBody(config, usedToken, body)
+	}
+
 	return types.ActionContinue
 }
 
@@ -64,17 +103,46 @@ func onHttpResponseHeaders(ctx wrapper.HttpContext, config config.SimpleConfig)
 		return types.ActionContinue
 	}
 
-	// 检查 Content-Type 是否为 JSON
-	contentType, err := proxywasm.GetHttpResponseHeader("content-type")
-	if err != nil || contentType == "" {
+	// 条件只引用状态码和响应头时，在响应头阶段直接判断，无需缓存响应体
+	if !token.InvalidConditionNeedsBody(config.TokenConfig) {
+		ctx.DontReadResponseBody()
+		tm := token.GetTokenManager(config)
+		status, headers := token.CurrentResponse()
+		if !tm.IsTokenInvalid(status, headers, nil, config) {
+			return types.ActionContinue
+		}
+		if retry.HandleRetryWithToken(ctx, config, tm) == types.ActionContinue {
+			return types.ActionContinue
+		}
+		// 等待刷新和重放完成，期间不向下游发送任何数据
+		return types.HeaderStopAllIterationAndWatermark
+	}
+
+	// wrapper 不会把带 content-encoding 或二进制类型的响应体交给插件，这类响应不检查响应体
+	if wrapper.IsBinaryResponseBody() {
+		log.Debugf("response body is encoded or binary, skip inspecting response body")
+		ctx.DontReadResponseBody()
 		return types.ActionContinue
 	}
 
-	if contentType != "application/json" && contentType != "application/json; charset=utf-8" {
+	// 只检查 content-type 匹配 inspect_media_types 的响应体
+	contentType, err := proxywasm.GetHttpResponseHeader("content-type")
+	if err != nil || !config.TokenConfig.InspectMatcher.Match(contentType) {
+		ctx.DontReadResponseBody()
 		return types.ActionContinue
 	}
+	// 已知超过 max_inspect_body_size 的响应不缓存响应体
+	if contentLength, err := proxywasm.GetHttpResponseHeader("content-length"); err == nil {
+		if size, err := strconv.ParseUint(contentLength, 10, 64); err == nil && size > uint64(config.TokenConfig.MaxInspectBodySize) {
+			log.Debugf("response body too large (%d bytes), skip inspecting response body", size)
+			ctx.DontReadResponseBody()
+			return types.ActionContinue
+		}
+	}
+	// 没有 content-length 的响应在缓存过程中按已缓存的大小限制
+	token.LimitInspectedBody(ctx, config.TokenConfig.MaxInspectBodySize)
 	// 暂停响应处理，等待检查响应体
-	return types.HeaderStopIteration // 暂停响应处理，等待检查响应体
+	return types.HeaderStopIteration
 }
 
 func onHttpResponseBody(ctx wrapper.HttpContext, config config.SimpleConfig, body []byte) types.Action {
@@ -83,10 +151,11 @@ func onHttpResponseBody(ctx wrapper.HttpContext, config config.SimpleConfig, bod
 		return types.ActionContinue
 	}
 
-	if token.GetTokenManager().IsTokenInvalid(body, config) {
+	status, headers := token.CurrentResponse()
+	if token.GetTokenManager(config).IsTokenInvalid(status, headers, body, config) {
 
 		// 处理重试逻辑
-		return retry.HandleRetryWithToken(ctx, config, token.GetTokenManager())
+		return retry.HandleRetryWithToken(ctx, config, token.GetTokenManager(config))
 	}
 	log.Infof("on token wasm plugin HttpResponse Body end")
 	return types.ActionContinue
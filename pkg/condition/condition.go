@@ -0,0 +1,230 @@
+package condition
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/expr-lang/expr"
+	"github.com/expr-lang/expr/ast"
+	"github.com/expr-lang/expr/vm"
+	"github.com/tidwall/gjson"
+)
+
+// Program 配置解析时编译好的条件表达式，运行时只需执行
+// 编译时记录表达式引用了响应体的哪些字段，运行时只用 gjson 读取这些字段，不解析整个响应体
+type Program struct {
+	*vm.Program
+	fields        []string // 直接引用的顶层字段，如 code != 0 中的 code
+	responseKeys  []string // 通过 response 引用的顶层字段，如 response.result.succ 中的 result
+	wholeResponse bool     // response 被整体使用（如 has(response, "x")），需要解析整个响应体
+}
+
+// httpName 表达式中响应状态码和响应头所在的名称：http.status、http.headers
+// 响应体中同名的顶层字段只能通过 response.http 访问
+const httpName = "http"
+
+// isNonBodyName 与响应体无关的名称：http 及函数库中的函数
+func isNonBodyName(name string) bool {
+	return name == httpName || functionNames[name]
+}
+
+// compileEnv 编译时使用的环境，确定内置名称的类型
+// 响应体的顶层字段在编译时未知，按未定义变量处理，运行时从环境中读取，不存在时为 nil
+var compileEnv = map[string]interface{}{
+	httpName: map[string]interface{}{
+		"status":  0,
+		"headers": map[string]interface{}{},
+	},
+	"response": map[string]interface{}{},
+}
+
+// Compile 编译条件表达式，表达式必须返回布尔值
+func Compile(source string) (*Program, error) {
+	patcher := &functionPatcher{}
+	options := append([]expr.Option{
+		expr.Env(compileEnv),
+		expr.AllowUndefinedVariables(),
+		expr.AsBool(),
+		expr.Patch(patcher),
+	}, functionOptions()...)
+	program, err := expr.Compile(source, options...)
+	if err != nil {
+		return nil, err
+	}
+	if patcher.err != nil {
+		return nil, patcher.err
+	}
+	p := &Program{Program: program}
+	if err := p.collectReferences(program.Node()); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// referenceCollector 收集表达式中引用的名称，以及 response 后直接跟常量字段名的访问
+// （如 response.result、jsonPath(response, "result.list[0]")），常量 jsonPath 路径在这里校验
+type referenceCollector struct {
+	idents   []*ast.IdentifierNode
+	accessed map[*ast.IdentifierNode]string
+	err      error
+}
+
+func (c *referenceCollector) Visit(node *ast.Node) {
+	switch n := (*node).(type) {
+	case *ast.IdentifierNode:
+		c.idents = append(c.idents, n)
+	case *ast.MemberNode:
+		ident, ok := n.Node.(*ast.IdentifierNode)
+		if !ok || ident.Value != "response" {
+			return
+		}
+		if key, ok := n.Property.(*ast.StringNode); ok {
+			c.accessed[ident] = key.Value
+		}
+	case *ast.CallNode:
+		callee, ok := n.Callee.(*ast.IdentifierNode)
+		if !ok || callee.Value != "jsonPath" || len(n.Arguments) != 2 {
+			return
+		}
+		path, ok := n.Arguments[1].(*ast.StringNode)
+		if !ok {
+			return
+		}
+		segments, err := parseJSONPath(path.Value)
+		if err != nil {
+			if c.err == nil {
+				c.err = err
+			}
+			return
+		}
+		if ident, ok := n.Arguments[0].(*ast.IdentifierNode); ok && ident.Value == "response" &&
+			len(segments) > 0 && segments[0].key != "" {
+			c.accessed[ident] = segments[0].key
+		}
+	}
+}
+
+// collectReferences 记录表达式引用的响应体字段
+func (p *Program) collectReferences(node ast.Node) error {
+	collector := &referenceCollector{accessed: make(map[*ast.IdentifierNode]string)}
+	ast.Walk(&node, collector)
+
+	seen := make(map[string]bool)
+	for _, ident := range collector.idents {
+		name := ident.Value
+		switch {
+		case isNonBodyName(name):
+		case name == "response":
+			key, ok := collector.accessed[ident]
+			if !ok {
+				p.wholeResponse = true
+			} else if !seen["response."+key] {
+				seen["response."+key] = true
+				p.responseKeys = append(p.responseKeys, key)
+			}
+		case !seen[name]:
+			seen[name] = true
+			p.fields = append(p.fields, name)
+		}
+	}
+	return collector.err
+}
+
+// NeedsBody 表达式是否需要响应体才能判断
+// 只引用 http.status、http.headers 的条件在响应头阶段就能判断，无需缓存响应体
+func (p *Program) NeedsBody() bool {
+	return p != nil && (len(p.fields) > 0 || len(p.responseKeys) > 0 || p.wholeResponse)
+}
+
+// Eval 执行表达式
+// 直接引用的顶层字段（如 code != 0 中的 code）在响应体中不存在时条件不成立，不执行表达式，
+// 避免 nil != 0 这类比较把不相关的响应判断为满足条件；通过 response 访问的字段不存在时为 nil
+func (p *Program) Eval(env map[string]interface{}) (bool, error) {
+	for _, name := range p.fields {
+		if _, ok := env[name]; !ok {
+			return false, nil
+		}
+	}
+	output, err := expr.Run(p.Program, env)
+	if err != nil {
+		return false, fmt.Errorf("执行表达式失败: %v", err)
+	}
+	result, ok := output.(bool)
+	if !ok {
+		return false, fmt.Errorf("表达式返回值不是布尔类型: %T, 值: %v", output, output)
+	}
+	return result, nil
+}
+
+// headerEnv 把响应头转换为表达式中的 http.headers：键为小写名称，多个值用 ", " 连接，不含伪头
+func headerEnv(headers http.Header) map[string]interface{} {
+	env := make(map[string]interface{}, len(headers))
+	for k, v := range headers {
+		name := strings.ToLower(k)
+		if strings.HasPrefix(name, ":") {
+			continue
+		}
+		if existing, ok := env[name].(string); ok {
+			env[name] = existing + ", " + strings.Join(v, ", ")
+			continue
+		}
+		env[name] = strings.Join(v, ", ")
+	}
+	return env
+}
+
+// NewEnv 根据响应状态码、响应头和 JSON 响应体构建表达式执行环境
+// 只读取表达式引用的字段；表达式不需要响应体，或 responseBody 为 nil、不是 JSON 对象时只提供 http
+func (p *Program) NewEnv(status int, headers http.Header, responseBody []byte) map[string]interface{} {
+	// 构建表达式执行环境
+	env := make(map[string]interface{}, len(p.fields)+3)
+
+	// 1. 注入响应状态码和响应头，支持 http.status == 401、header("www-authenticate") contains "invalid_token"
+	env[httpName] = map[string]interface{}{
+		"status":  status,
+		"headers": headerEnv(headers),
+	}
+
+	if !p.NeedsBody() || !isJSONObject(responseBody) {
+		env["response"] = map[string]interface{}(nil)
+		return env
+	}
+
+	// 2. 注入引用到的顶层字段，支持直接写 code != 0，不存在的字段为 nil
+	// GetBytes 直接在原始字节上查找，不复制整个响应体
+	for _, name := range p.fields {
+		if v := gjson.GetBytes(responseBody, gjson.Escape(name)); v.Exists() {
+			env[name] = v.Value()
+		}
+	}
+
+	// 3. 注入 response，支持嵌套访问（如 response.result.succ），只包含引用到的顶层字段
+	if p.wholeResponse {
+		env["response"] = gjson.ParseBytes(responseBody).Value()
+		return env
+	}
+	response := make(map[string]interface{}, len(p.responseKeys))
+	for _, key := range p.responseKeys {
+		if v := gjson.GetBytes(responseBody, gjson.Escape(key)); v.Exists() {
+			response[key] = v.Value()
+		}
+	}
+	env["response"] = response
+	return env
+}
+
+// isJSONObject 响应体是否为 JSON 对象：合法 JSON 且第一个非空白字符为 {
+func isJSONObject(body []byte) bool {
+	if !gjson.ValidBytes(body) {
+		return false
+	}
+	for _, c := range body {
+		switch c {
+		case ' ', '\t', '\n', '\r':
+			continue
+		}
+		return c == '{'
+	}
+	return false
+}
@@ -0,0 +1,269 @@
+package condition
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestCompileErrors(t *testing.T) {
+	// 加载配置时就应报错的表达式
+	tests := []string{
+		`msg matches "("`,
+		`jsonPath(response, "data[x]")`,
+		`jsonPath(response, "data..x")`,
+		`lower(msg)`,
+		`code ==`,
+		`contains(msg, "x")`,
+	}
+	for _, source := range tests {
+		if _, err := Compile(source); err == nil {
+			t.Errorf("Compile(%q) error = nil, want error", source)
+		}
+	}
+}
+
+func TestNeedsBody(t *testing.T) {
+	tests := []struct {
+		condition string
+		want      bool
+	}{
+		{`header("www-authenticate") contains "invalid_token"`, false},
+		{`http.status == 401 || lower(header("x-error")) == "expired"`, false},
+		{`http.headers["x-error"] != ""`, false},
+		{`toInt(code) == 401`, true},
+		{`status == "expired"`, true},
+		{`response.result.succ == false`, true},
+		{`jsonPath(response, "data.list[0]") == nil`, true},
+		{`has(response, "error")`, true},
+	}
+	for _, tt := range tests {
+		program, err := Compile(tt.condition)
+		if err != nil {
+			t.Fatalf("Compile(%q) error = %v", tt.condition, err)
+		}
+		if got := program.NeedsBody(); got != tt.want {
+			t.Errorf("NeedsBody(%q) = %v, want %v", tt.condition, got, tt.want)
+		}
+	}
+
+	var none *Program
+	if none.NeedsBody() {
+		t.Errorf("nil Program needs body")
+	}
+}
+
+func TestNewEnvReadsReferencedFields(t *testing.T) {
+	body := []byte(`{"code":1,"msg":"expired","result":{"succ":false},"data":[1,2,3],"status":"locked"}`)
+	headers := http.Header{"Www-Authenticate": {"Bearer"}, ":status": {"401"}}
+	tests := []struct {
+		condition string
+		want      map[string]interface{}
+	}{
+		{
+			condition: `code != 0`,
+			want:      map[string]interface{}{"code": float64(1), "response": map[string]interface{}{}},
+		},
+		{
+			condition: `response.result.succ == false && response.missing == nil`,
+			want: map[string]interface{}{
+				"response": map[string]interface{}{"result": map[string]interface{}{"succ": false}},
+			},
+		},
+		{
+			condition: `jsonPath(response, "data[1]") == 2`,
+			want:      map[string]interface{}{"response": map[string]interface{}{"data": []interface{}{float64(1), float64(2), float64(3)}}},
+		},
+		{
+			condition: `status == "locked" && http.status == 401`,
+			want:      map[string]interface{}{"status": "locked", "response": map[string]interface{}{}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.condition, func(t *testing.T) {
+			program, err := Compile(tt.condition)
+			if err != nil {
+				t.Fatalf("Compile() error = %v", err)
+			}
+			env := program.NewEnv(401, headers, body)
+			if ok, err := program.Eval(env); err != nil || !ok {
+				t.Errorf("Eval() = %v, %v, want true", ok, err)
+			}
+			wantHTTP := map[string]interface{}{
+				"status":  401,
+				"headers": map[string]interface{}{"www-authenticate": "Bearer"},
+			}
+			if !reflect.DeepEqual(env[httpName], wantHTTP) {
+				t.Errorf("env[http] = %#v, want %#v", env[httpName], wantHTTP)
+			}
+			delete(env, httpName)
+			if !reflect.DeepEqual(env, tt.want) {
+				t.Errorf("env = %#v, want %#v", env, tt.want)
+			}
+		})
+	}
+}
+
+func TestNewEnvWholeResponse(t *testing.T) {
+	program, err := Compile(`has(response, "code")`)
+	if err != nil {
+		t.Fatalf("Compile() error = %v", err)
+	}
+	env := program.NewEnv(200, nil, []byte(`{"code":0,"msg":"ok"}`))
+	want := map[string]interface{}{"code": float64(0), "msg": "ok"}
+	if !reflect.DeepEqual(env["response"], want) {
+		t.Errorf("env[response] = %#v, want %#v", env["response"], want)
+	}
+}
+
+func TestNewEnvWithoutBodyFields(t *testing.T) {
+	program, err := Compile(`code != 0`)
+	if err != nil {
+		t.Fatalf("Compile() error = %v", err)
+	}
+	// 不是 JSON 对象的响应体没有任何字段，不报错
+	for _, body := range []string{`{"code":`, `<html></html>`, `[{"code":1}]`, ` "text"`, ``} {
+		env := program.NewEnv(200, nil, []byte(body))
+		if _, ok := env["code"]; ok {
+			t.Errorf("NewEnv(%q) provided body field code", body)
+		}
+		if ok, err := program.Eval(env); err != nil || ok {
+			t.Errorf("Eval() with %q = %v (%v), want false", body, ok, err)
+		}
+	}
+
+	// 只引用状态码和响应头的表达式不读取响应体，任意响应体都能判断
+	statusOnly, err := Compile(`http.status == 401`)
+	if err != nil {
+		t.Fatalf("Compile() error = %v", err)
+	}
+	for _, body := range []string{`{"code":1}`, `unauthorized`, `[1]`, ``} {
+		env := statusOnly.NewEnv(401, nil, []byte(body))
+		if env["response"] != nil && len(env["response"].(map[string]interface{})) != 0 {
+			t.Errorf("NewEnv(%q) read the body for a status-only condition: %#v", body, env["response"])
+		}
+		if ok, err := statusOnly.Eval(env); err != nil || !ok {
+			t.Errorf("Eval() with %q = %v (%v), want true", body, ok, err)
+		}
+	}
+}
+
+func TestEvalMissingFields(t *testing.T) {
+	// 直接引用的字段不存在时条件不成立，而不是按 nil 参与比较
+	tests := []struct {
+		condition string
+		body      string
+		want      bool
+	}{
+		{`code != 0`, `{"msg":"ok"}`, false},
+		{`code != 0`, `{"code":40101}`, true},
+		{`code != 0 || msg == "ok"`, `{"msg":"ok"}`, false},
+		{`any(items, # > 1)`, `{"msg":"ok"}`, false},
+		{`any(items, # > 1)`, `{"items":[1,2]}`, true},
+		{`code == nil`, `{"code":null}`, true},
+		{`response.code != 0`, `{"msg":"ok"}`, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.condition+" "+tt.body, func(t *testing.T) {
+			program, err := Compile(tt.condition)
+			if err != nil {
+				t.Fatalf("Compile() error = %v", err)
+			}
+			got, err := program.Eval(program.NewEnv(200, nil, []byte(tt.body)))
+			if err != nil || got != tt.want {
+				t.Errorf("Eval() = %v (%v), want %v", got, err, tt.want)
+			}
+		})
+	}
+}
+
+// benchCondition 基准测试使用的条件：只引用响应体开头的少量字段
+const benchCondition = "code != 0 || response.result.succ == false"
+
+// reportBody 生成类似 OA 报表接口的响应体，code、result 在前，大数组在后
+func reportBody(rows int) []byte {
+	var sb strings.Builder
+	sb.WriteString(`{"code":0,"msg":"success","result":{"succ":true,"total":`)
+	fmt.Fprintf(&sb, "%d", rows)
+	sb.WriteString(`},"data":[`)
+	for i := 0; i < rows; i++ {
+		if i > 0 {
+			sb.WriteByte(',')
+		}
+		fmt.Fprintf(&sb, `{"id":%d,"name":"employee-%d","dept":"研发中心","amount":%d.25,"approved":%t,"tags":["a","b","c"]}`,
+			i, i, i*13, i%3 == 0)
+	}
+	sb.WriteString(`]}`)
+	return []byte(sb.String())
+}
+
+// unmarshalEnv 按需读取字段之前的实现：json.Unmarshal 整个响应体，并把所有顶层字段复制到执行环境中
+func unmarshalEnv(status int, headers http.Header, responseBody []byte) (map[string]interface{}, error) {
+	var response map[string]interface{}
+	if responseBody != nil {
+		if err := json.Unmarshal(responseBody, &response); err != nil {
+			return nil, err
+		}
+	}
+
+	env := make(map[string]interface{})
+	env["contains"] = func(a, b interface{}) bool {
+		s, ok1 := a.(string)
+		sub, ok2 := b.(string)
+		return ok1 && ok2 && strings.Contains(s, sub)
+	}
+	env["has"] = func(mapVar map[string]interface{}, key string) bool {
+		_, exists := mapVar[key]
+		return exists
+	}
+	env["status"] = status
+	env["headers"] = headerEnv(headers)
+	for k, v := range response {
+		if _, exists := env[k]; !exists {
+			env[k] = v
+		}
+	}
+	env["response"] = response
+	return env, nil
+}
+
+// benchmarkNewEnv 用 newEnv 构建执行环境并执行 benchCondition
+func benchmarkNewEnv(b *testing.B, newEnv func(*Program, []byte) (map[string]interface{}, error)) {
+	program, err := Compile(benchCondition)
+	if err != nil {
+		b.Fatalf("Compile() error = %v", err)
+	}
+	for _, rows := range []int{10, 1000, 20000} {
+		body := reportBody(rows)
+		b.Run(fmt.Sprintf("rows=%d", rows), func(b *testing.B) {
+			b.SetBytes(int64(len(body)))
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				env, err := newEnv(program, body)
+				if err != nil {
+					b.Fatal(err)
+				}
+				if _, err := program.Eval(env); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+var benchHeaders = http.Header{"Content-Type": {"application/json"}}
+
+func BenchmarkNewEnvUnmarshal(b *testing.B) {
+	benchmarkNewEnv(b, func(_ *Program, body []byte) (map[string]interface{}, error) {
+		return unmarshalEnv(200, benchHeaders, body)
+	})
+}
+
+func BenchmarkNewEnvGjson(b *testing.B) {
+	benchmarkNewEnv(b, func(program *Program, body []byte) (map[string]interface{}, error) {
+		return program.NewEnv(200, benchHeaders, body), nil
+	})
+}
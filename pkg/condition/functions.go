@@ -0,0 +1,292 @@
+package condition
+
+import (
+	"fmt"
+	"math"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/expr-lang/expr"
+	"github.com/expr-lang/expr/ast"
+)
+
+// function 条件表达式可以调用的函数，所有表达式（invalid_token_condition、token_success_condition）共用
+// 函数对类型宽松：响应字段可能是字符串也可能是数字（如 code 为 "401" 或 401），不会因类型不符而报错
+type function struct {
+	name  string
+	fn    func(params ...interface{}) (interface{}, error)
+	types []interface{}
+}
+
+var functions = []function{
+	{"has", fnHas, []interface{}{new(func(interface{}, string) bool)}},
+	{"header", fnHeader, []interface{}{new(func(map[string]interface{}, string) string)}},
+	{"lower", fnLower, []interface{}{new(func(interface{}) string)}},
+	{"upper", fnUpper, []interface{}{new(func(interface{}) string)}},
+	{"contains", fnContains, []interface{}{new(func(interface{}, interface{}) bool)}},
+	{"startsWith", fnStartsWith, []interface{}{new(func(interface{}, interface{}) bool)}},
+	{"endsWith", fnEndsWith, []interface{}{new(func(interface{}, interface{}) bool)}},
+	{"matches", fnMatches, []interface{}{new(func(interface{}, interface{}) bool)}},
+	{"jsonPath", fnJSONPath, []interface{}{new(func(interface{}, string) interface{})}},
+	{"now", fnNow, []interface{}{new(func() int64)}},
+	{"toString", fnToString, []interface{}{new(func(interface{}) string)}},
+	{"toNumber", fnToNumber, []interface{}{new(func(interface{}) interface{})}},
+	{"toInt", fnToInt, []interface{}{new(func(interface{}) interface{})}},
+}
+
+// functionNames 函数名集合，用于区分函数名和响应体字段
+var functionNames = func() map[string]bool {
+	names := make(map[string]bool, len(functions))
+	for _, f := range functions {
+		names[f.name] = true
+	}
+	return names
+}()
+
+// functionOptions 编译表达式时注册的函数
+func functionOptions() []expr.Option {
+	options := make([]expr.Option, 0, len(functions))
+	for _, f := range functions {
+		options = append(options, expr.Function(f.name, f.fn, f.types...))
+	}
+	return options
+}
+
+// stringOperators expr 中以中缀运算符形式出现的字符串函数，如 code matches "^40"
+var stringOperators = map[string]bool{
+	"contains":   true,
+	"startsWith": true,
+	"endsWith":   true,
+	"matches":    true,
+}
+
+// functionPatcher 改写表达式，让运算符和 header() 使用函数库中的实现
+//   - a matches b、a startsWith b 等改为调用同名函数，非字符串的操作数先转换为字符串，
+//     常量正则在加载配置时校验
+//   - header(name) 改为 header(http.headers, name)
+type functionPatcher struct {
+	err error
+}
+
+func (p *functionPatcher) Visit(node *ast.Node) {
+	switch n := (*node).(type) {
+	case *ast.BinaryNode:
+		if !stringOperators[n.Operator] {
+			return
+		}
+		if pattern, ok := n.Right.(*ast.StringNode); ok && n.Operator == "matches" && p.err == nil {
+			if _, err := compileRegexp(pattern.Value); err != nil {
+				p.err = err
+			}
+		}
+		ast.Patch(node, &ast.CallNode{
+			Callee:    &ast.IdentifierNode{Value: n.Operator},
+			Arguments: []ast.Node{n.Left, n.Right},
+		})
+	case *ast.CallNode:
+		if callee, ok := n.Callee.(*ast.IdentifierNode); ok && callee.Value == "header" && len(n.Arguments) == 1 {
+			headers := &ast.MemberNode{
+				Node:     &ast.IdentifierNode{Value: httpName},
+				Property: &ast.StringNode{Value: "headers"},
+			}
+			n.Arguments = []ast.Node{headers, n.Arguments[0]}
+		}
+	}
+}
+
+func fnHas(params ...interface{}) (interface{}, error) {
+	m, ok := params[0].(map[string]interface{})
+	if !ok {
+		return false, nil
+	}
+	_, exists := m[params[1].(string)]
+	return exists, nil
+}
+
+func fnHeader(params ...interface{}) (interface{}, error) {
+	headers, _ := params[0].(map[string]interface{})
+	value, _ := headers[strings.ToLower(params[1].(string))].(string)
+	return value, nil
+}
+
+func fnLower(params ...interface{}) (interface{}, error) {
+	return strings.ToLower(toString(params[0])), nil
+}
+
+func fnUpper(params ...interface{}) (interface{}, error) {
+	return strings.ToUpper(toString(params[0])), nil
+}
+
+func fnContains(params ...interface{}) (interface{}, error) {
+	return strings.Contains(toString(params[0]), toString(params[1])), nil
+}
+
+func fnStartsWith(params ...interface{}) (interface{}, error) {
+	return strings.HasPrefix(toString(params[0]), toString(params[1])), nil
+}
+
+func fnEndsWith(params ...interface{}) (interface{}, error) {
+	return strings.HasSuffix(toString(params[0]), toString(params[1])), nil
+}
+
+func fnMatches(params ...interface{}) (interface{}, error) {
+	re, err := compileRegexp(toString(params[1]))
+	if err != nil {
+		return false, err
+	}
+	return re.MatchString(toString(params[0])), nil
+}
+
+func fnJSONPath(params ...interface{}) (interface{}, error) {
+	segments, err := parseJSONPath(params[1].(string))
+	if err != nil {
+		return nil, err
+	}
+	value := params[0]
+	for _, segment := range segments {
+		switch v := value.(type) {
+		case map[string]interface{}:
+			if segment.key == "" {
+				return nil, nil
+			}
+			value = v[segment.key]
+		case []interface{}:
+			if segment.key != "" || segment.index >= len(v) {
+				return nil, nil
+			}
+			value = v[segment.index]
+		default:
+			return nil, nil
+		}
+	}
+	return value, nil
+}
+
+func fnNow(params ...interface{}) (interface{}, error) {
+	return time.Now().Unix(), nil
+}
+
+func fnToString(params ...interface{}) (interface{}, error) {
+	return toString(params[0]), nil
+}
+
+func fnToNumber(params ...interface{}) (interface{}, error) {
+	if n, ok := toNumber(params[0]); ok {
+		return n, nil
+	}
+	return nil, nil
+}
+
+func fnToInt(params ...interface{}) (interface{}, error) {
+	if s, ok := params[0].(string); ok {
+		if n, err := strconv.ParseInt(strings.TrimSpace(s), 10, 64); err == nil {
+			return int(n), nil
+		}
+	}
+	n, ok := toNumber(params[0])
+	if !ok || math.IsNaN(n) || math.IsInf(n, 0) {
+		return nil, nil
+	}
+	return int(n), nil
+}
+
+// toString 把响应字段转换为字符串：nil 为空字符串，数字不使用科学计数法
+func toString(v interface{}) string {
+	switch s := v.(type) {
+	case nil:
+		return ""
+	case string:
+		return s
+	case float64:
+		return strconv.FormatFloat(s, 'f', -1, 64)
+	case bool:
+		return strconv.FormatBool(s)
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+// toNumber 把响应字段转换为数字，字符串按十进制解析，布尔值为 1/0，无法转换时返回 false
+func toNumber(v interface{}) (float64, bool) {
+	switch n := v.(type) {
+	case string:
+		f, err := strconv.ParseFloat(strings.TrimSpace(n), 64)
+		return f, err == nil
+	case bool:
+		if n {
+			return 1, true
+		}
+		return 0, true
+	}
+	rv := reflect.ValueOf(v)
+	switch rv.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return float64(rv.Int()), true
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return float64(rv.Uint()), true
+	case reflect.Float32, reflect.Float64:
+		return rv.Float(), true
+	}
+	return 0, false
+}
+
+// regexpCache 编译过的正则，表达式中的正则通常是常量，只需编译一次
+var (
+	regexpMu    sync.Mutex
+	regexpCache = make(map[string]*regexp.Regexp)
+)
+
+func compileRegexp(pattern string) (*regexp.Regexp, error) {
+	regexpMu.Lock()
+	defer regexpMu.Unlock()
+	if re, ok := regexpCache[pattern]; ok {
+		return re, nil
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, fmt.Errorf("invalid regexp %q: %v", pattern, err)
+	}
+	regexpCache[pattern] = re
+	return re, nil
+}
+
+// pathSegment jsonPath 中的一段：对象字段名或数组下标
+type pathSegment struct {
+	key   string
+	index int
+}
+
+// parseJSONPath 解析 jsonPath 的路径，如 a.b[0]、$.data.list[1].name，开头的 $ 可以省略
+func parseJSONPath(path string) ([]pathSegment, error) {
+	rest := strings.TrimPrefix(strings.TrimPrefix(path, "$"), ".")
+	var segments []pathSegment
+	for rest != "" {
+		if rest[0] == '[' {
+			end := strings.IndexByte(rest, ']')
+			if end < 0 {
+				return nil, fmt.Errorf("invalid json path %q: missing ]", path)
+			}
+			index, err := strconv.Atoi(rest[1:end])
+			if err != nil || index < 0 {
+				return nil, fmt.Errorf("invalid json path %q: bad index %q", path, rest[1:end])
+			}
+			segments = append(segments, pathSegment{index: index})
+			rest = strings.TrimPrefix(rest[end+1:], ".")
+			continue
+		}
+		end := strings.IndexAny(rest, ".[")
+		if end < 0 {
+			end = len(rest)
+		}
+		if end == 0 {
+			return nil, fmt.Errorf("invalid json path %q: empty field name", path)
+		}
+		segments = append(segments, pathSegment{key: rest[:end]})
+		rest = strings.TrimPrefix(rest[end:], ".")
+	}
+	return segments, nil
+}
@@ -0,0 +1,108 @@
+package condition
+
+import (
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+)
+
+var bearerHeaders = http.Header{
+	"Www-Authenticate": {`Bearer error="invalid_token"`},
+	"Content-Type":     {"application/json"},
+}
+
+func TestFunctions(t *testing.T) {
+	tests := []struct {
+		condition string
+		status    int
+		headers   http.Header
+		body      string // 为空时按只有响应头处理
+		want      bool
+	}{
+		// 数字编码兼容：code 可能是 "401" 或 401
+		{condition: `toInt(code) == 401`, body: `{"code":"401"}`, want: true},
+		{condition: `toInt(code) == 401`, body: `{"code":401}`, want: true},
+		{condition: `toInt(code) == 401`, body: `{"code":"401.0"}`, want: true},
+		{condition: `toInt(code) == 401`, body: `{"msg":"no code"}`, want: false},
+		{condition: `toInt(code) == nil`, body: `{"code":"abc"}`, want: true},
+		{condition: `toNumber(code) >= 400`, body: `{"code":"401"}`, want: true},
+		{condition: `toNumber(response.result.code) == 40.5`, body: `{"result":{"code":"40.5"}}`, want: true},
+		{condition: `toString(code) == "401"`, body: `{"code":401}`, want: true},
+		{condition: `toString(code) == "12345678901"`, body: `{"code":12345678901}`, want: true},
+		{condition: `toString(ok) == "true"`, body: `{"ok":true}`, want: true},
+
+		// 字符串函数，非字符串参数先转换为字符串
+		{condition: `lower(msg) == "token expired"`, body: `{"msg":"Token EXPIRED"}`, want: true},
+		{condition: `upper(msg) == "TOKEN EXPIRED"`, body: `{"msg":"Token expired"}`, want: true},
+		{condition: `lower(response.missing) == ""`, body: `{"msg":"x"}`, want: true},
+		{condition: `msg startsWith "token"`, body: `{"msg":"token expired"}`, want: true},
+		{condition: `code startsWith "40"`, body: `{"code":401}`, want: true},
+		{condition: `msg endsWith "expired"`, body: `{"msg":"token expired"}`, want: true},
+		{condition: `msg contains "expired"`, body: `{"msg":"token expired"}`, want: true},
+		{condition: `missing contains "expired"`, body: `{"msg":"token expired"}`, want: false},
+		{condition: `msg matches "(?i)^token (expired|invalid)$"`, body: `{"msg":"Token Invalid"}`, want: true},
+		{condition: `code matches "^40[13]$"`, body: `{"code":403}`, want: true},
+		{condition: `code matches "^40[13]$"`, body: `{"code":404}`, want: false},
+		{condition: `not (msg matches "expired")`, body: `{"msg":"ok"}`, want: true},
+
+		// 响应头
+		{condition: `header("www-authenticate") contains "invalid_token"`, status: 401, headers: bearerHeaders, want: true},
+		{condition: `header("WWW-Authenticate") matches "error=\"invalid_token\""`, status: 401, headers: bearerHeaders, want: true},
+		{condition: `header("x-missing") == ""`, headers: bearerHeaders, want: true},
+		{condition: `http.status == 401 && http.headers["www-authenticate"] startsWith "Bearer"`, status: 401, headers: bearerHeaders, want: true},
+		// status、headers 是普通的响应体字段
+		{condition: `status == "expired"`, body: `{"status":"expired"}`, status: 401, want: true},
+		{condition: `response.headers == nil && http.status == 401`, body: `{"code":1}`, status: 401, want: true},
+
+		// jsonPath
+		{condition: `jsonPath(response, "data.list[1].state") == "expired"`, body: `{"data":{"list":[{"state":"ok"},{"state":"expired"}]}}`, want: true},
+		{condition: `jsonPath(response, "$.data.list[0][1]") == 2`, body: `{"data":{"list":[[1,2]]}}`, want: true},
+		{condition: `jsonPath(response, "data.list[5].state") == nil`, body: `{"data":{"list":[]}}`, want: true},
+		{condition: `jsonPath(response, "data.x.y") == nil`, body: `{"data":"scalar"}`, want: true},
+		{condition: `jsonPath(data, "errors[0].code") == "TOKEN_EXPIRED"`, body: `{"data":{"errors":[{"code":"TOKEN_EXPIRED"}]}}`, want: true},
+
+		// has、now
+		{condition: `has(response, "error")`, body: `{"error":null}`, want: true},
+		{condition: `has(response, "error")`, body: `{"ok":1}`, want: false},
+		{condition: `has(data, "token")`, body: `{"data":"not an object"}`, want: false},
+		{condition: `toInt(expires_at) < now()`, body: `{"expires_at":"1000"}`, want: true},
+		{condition: `toInt(expires_at) < now()`, body: `{"expires_at":` + strconv.FormatInt(time.Now().Add(time.Hour).Unix(), 10) + `}`, want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.condition, func(t *testing.T) {
+			program, err := Compile(tt.condition)
+			if err != nil {
+				t.Fatalf("Compile() error = %v", err)
+			}
+			var body []byte
+			if tt.body != "" {
+				body = []byte(tt.body)
+			}
+			got, err := program.Eval(program.NewEnv(tt.status, tt.headers, body))
+			if err != nil || got != tt.want {
+				t.Errorf("Eval() with %s = %v (%v), want %v", tt.body, got, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestToString(t *testing.T) {
+	tests := []struct {
+		in   interface{}
+		want string
+	}{
+		{nil, ""},
+		{"abc", "abc"},
+		{float64(401), "401"},
+		{float64(12345678901), "12345678901"},
+		{40.5, "40.5"},
+		{true, "true"},
+		{401, "401"},
+	}
+	for _, tt := range tests {
+		if got := toString(tt.in); got != tt.want {
+			t.Errorf("toString(%#v) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
@@ -1,30 +1,171 @@
 package config
 
 import (
+	"bst-auth/pkg/condition"
+	"bst-auth/pkg/contentcoding"
+	"bst-auth/pkg/mediatype"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"strings"
+
 	"github.com/higress-group/wasm-go/pkg/wrapper"
 	"github.com/tidwall/gjson"
 )
 
+const (
+	// DefaultRefreshSkew 默认在 Token 过期前 30 秒主动刷新
+	DefaultRefreshSkew = 30
+	// DefaultMaxPendingRequests 默认最多允许 1000 个请求同时等待 Token
+	DefaultMaxPendingRequests = 1000
+	// DefaultRetryTimeout 重放请求默认超时 5 秒
+	DefaultRetryTimeout = 5000
+	// DefaultMaxInspectBodySize 默认最多检查 4MB 的响应体，压缩的响应按解码后的大小计算
+	DefaultMaxInspectBodySize = contentcoding.DefaultMaxDecodedSize
+
+	// 调用 token 服务的错误类型，用于 token_fetch_retry.retryable_errors
+	// FetchErrorTimeout 未收到响应：超时、连接失败或连接被重置
+	FetchErrorTimeout = "timeout"
+	// FetchErrorDispatchFailed 请求无法发出，如集群不存在
+	FetchErrorDispatchFailed = "dispatch_failed"
+
+	// on_token_failure 取值：无法获取 Token 时如何处理请求
+	OnTokenFailureDeny            = "deny"              // 返回错误响应（默认）
+	OnTokenFailureAllow           = "allow"             // 不带 Token 放行
+	OnTokenFailureAllowWithHeader = "allow_with_header" // 不带 Token 放行，并加上 DegradedHeader
+	// DegradedHeader 不带 Token 放行时给上游的标记头，值为失败原因
+	DegradedHeader = "x-ext-auth-degraded"
+
+	// on_retries_exhausted 取值：重放次数用尽、上游仍判定 token 无效时如何响应
+	OnRetriesExhaustedPassthrough = "passthrough" // 原样返回上游响应
+	OnRetriesExhaustedError       = "error"       // 返回 error_responses.retries_exhausted
+
+	// error_responses 中的失败类型
+	ErrorKindFetchFailed      = "fetch_failed"      // 获取 token 失败
+	ErrorKindEmptyToken       = "empty_token"       // token 服务返回了空 token
+	ErrorKindRetryFailed      = "retry_failed"      // 刷新 token 后重放请求失败
+	ErrorKindRetriesExhausted = "retries_exhausted" // 重放次数用尽，上游仍判定 token 无效
+
+	// token_injection.format 中的内置占位符名称
+	PlaceholderToken     = "token"
+	PlaceholderTokenType = "token_type"
+
+	// Token 在 token 服务响应中的位置
+	TokenSourceBody   = "body"
+	TokenSourceHeader = "header"
+	TokenSourceCookie = "cookie"
+
+	// GrantTypeClientCredentials 标准 OAuth2 client_credentials 授权模式
+	GrantTypeClientCredentials = "client_credentials"
+
+	// AuthMethodClientSecretBasic 通过 Authorization: Basic 头发送 client_id/client_secret
+	AuthMethodClientSecretBasic = "client_secret_basic"
+	// AuthMethodClientSecretPost 通过表单字段发送 client_id/client_secret
+	AuthMethodClientSecretPost = "client_secret_post"
+)
+
 type TokenConfig struct {
-	Enabled               bool             `json:"enabled"`
-	Credential            Credential       `json:"credential"`
-	TokenPath             string           `json:"token_path"`
-	Timeout               uint32           `json:"timeout"`
-	TokenExtraction       TokenExtraction  `json:"token_extraction"`
-	TokenInjection        []TokenInjection `json:"token_injection"`
-	InvalidTokenCondition string           `json:"invalid_token_condition"`
-	RetrySendTimes        int              `json:"retry_send_times"`
+	Enabled               bool                     `json:"enabled"`
+	GrantType             string                   `json:"grant_type"` // 为空时使用 form_fields 自定义请求，可选 client_credentials
+	Credential            Credential               `json:"credential"`
+	TokenPath             string                   `json:"token_path"`
+	Timeout               uint32                   `json:"timeout"`
+	TokenExtraction       TokenExtraction          `json:"token_extraction"`
+	TokenInjection        []TokenInjection         `json:"token_injection"`
+	InvalidTokenCondition string                   `json:"invalid_token_condition"`
+	TokenSuccessCondition string                   `json:"token_success_condition"`  // token 服务响应可用的条件，为空时仅要求 HTTP 200
+	TokenErrorMessagePath string                   `json:"token_error_message_path"` // token 服务错误信息在响应体中的路径
+	RetrySendTimes        int                      `json:"retry_send_times"`
+	RefreshSkew           int64                    `json:"refresh_skew"`           // 过期前多少秒主动刷新 Token
+	MaxPendingRequests    int                      `json:"max_pending_requests"`   // 等待 Token 的请求数上限
+	ProviderID            string                   `json:"provider_id"`            // Token 缓存标识，相同标识的路由共用一份 Token
+	FetchRetry            FetchRetry               `json:"token_fetch_retry"`      // 调用 token 服务失败时的重试策略
+	CircuitBreaker        CircuitBreaker           `json:"circuit_breaker"`        // token 服务熔断
+	StaleWhileRevalidate  int64                    `json:"stale_while_revalidate"` // Token 过期或被拒绝后继续使用旧 Token 的秒数，期间后台刷新
+	StaleIfError          int64                    `json:"stale_if_error"`         // 刷新失败时继续使用旧 Token 的秒数
+	OnTokenFailure        string                   `json:"on_token_failure"`       // 无法获取 Token 时：deny（默认）, allow, allow_with_header
+	ErrorResponses        map[string]ErrorResponse `json:"error_responses"`        // 按失败类型自定义错误响应，未配置的类型使用内置响应
+	OnRetriesExhausted    string                   `json:"on_retries_exhausted"`   // 重放次数用尽时：passthrough, error
+	RetryTimeout          uint32                   `json:"retry_timeout"`          // 每次重放请求的超时时间（毫秒）
+	RetryBackoff          Backoff                  `json:"retry_backoff"`          // 刷新 token 后重放前的退避等待
+	RetryDeadline         uint32                   `json:"retry_deadline"`         // 所有重放的总时限（毫秒），0 表示不限制
+	RetryMarkerHeader     string                   `json:"retry_marker_header"`    // 不为空时给重放得到的响应加上该头，值为重放次数
+	InspectMediaTypes     []string                 `json:"inspect_media_types"`    // 需要检查响应体的 content-type 规则
+	MaxInspectBodySize    uint32                   `json:"max_inspect_body_size"`  // 检查响应体的大小上限（字节），超过时只按状态码和响应头判断
+
+	// InspectMatcher 由 inspect_media_types 解析得到
+	InspectMatcher *mediatype.Matcher `json:"-"`
+
+	// InvalidTokenProgram、TokenSuccessProgram 为配置解析时编译好的条件表达式，未配置时为 nil
+	InvalidTokenProgram *condition.Program `json:"-"`
+	TokenSuccessProgram *condition.Program `json:"-"`
+
+	// CacheKey Token 缓存实际使用的标识：优先使用 provider_id，
+	// 未配置时由 token 服务地址和凭证计算得出
+	CacheKey string `json:"-"`
 }
 
 type Credential struct {
 	FormFields map[string]string `json:"form_fields"`
 	HeadFields map[string]string `json:"head_fields"`
+
+	// 以下字段仅在 grant_type 为 client_credentials 时使用
+	ClientID     string `json:"client_id"`
+	ClientSecret string `json:"client_secret"`
+	AuthMethod   string `json:"auth_method"` // client_secret_basic（默认）, client_secret_post
+	Scope        string `json:"scope"`
+	Audience     string `json:"audience"`
 }
 
-type TokenExtraction struct {
+// ValueExtraction 描述一个值在 token 服务响应中的位置
+type ValueExtraction struct {
+	Source       string `json:"source"`      // body（默认）, header, cookie
+	HeaderName   string `json:"header_name"` // source 为 header 时读取的响应头
+	CookieName   string `json:"cookie_name"` // source 为 cookie 时读取的 Set-Cookie 名称
 	ResponsePath string `json:"response_path"`
 }
 
+type TokenExtraction struct {
+	ValueExtraction                            // Token 本身的位置
+	ExpiresInPath   string                     `json:"expires_in_path"` // 有效期（秒）在响应中的路径
+	ExpiryFromJwt   bool                       `json:"expiry_from_jwt"` // 从 JWT 格式 Token 的 exp 声明中解析过期时间
+	Values          map[string]ValueExtraction `json:"values"`          // 随 Token 一起提取的其他值，注入时用 {名称} 引用
+}
+
+// Backoff 指数退避：第 n 次重试前等待 base_delay * 2^(n-1)，不超过 max_delay，再加上随机浮动
+type Backoff struct {
+	BaseDelay uint32  `json:"base_delay"` // 第一次重试前的等待时间（毫秒），之后每次翻倍
+	MaxDelay  uint32  `json:"max_delay"`  // 单次等待时间上限（毫秒）
+	Jitter    float64 `json:"jitter"`     // 等待时间的随机浮动比例，0~1
+}
+
+// FetchRetry 调用 token 服务失败时的重试策略，重试期间原请求保持暂停
+type FetchRetry struct {
+	Backoff
+	MaxAttempts       int      `json:"max_attempts"`       // 最多调用次数（含第一次），默认 1 即不重试
+	RetryableStatuses []int    `json:"retryable_statuses"` // 可重试的 HTTP 状态码
+	RetryableErrors   []string `json:"retryable_errors"`   // 可重试的调用错误：timeout, dispatch_failed
+}
+
+// CircuitBreaker token 服务熔断配置，状态通过共享数据在所有 VM 间共享
+type CircuitBreaker struct {
+	Enabled              bool    `json:"enabled"`
+	FailureRateThreshold float64 `json:"failure_rate_threshold"` // 统计窗口内失败比例达到该值时熔断，0~1
+	MinimumRequests      int     `json:"minimum_requests"`       // 统计窗口内至少有这么多次调用才判断失败比例
+	Window               int64   `json:"window"`                 // 统计窗口（秒）
+	Cooldown             int64   `json:"cooldown"`               // 熔断后多久（秒）放行一次探测请求
+	OpenStatusCode       uint32  `json:"open_status_code"`       // 熔断期间直接返回的状态码
+	OpenBody             string  `json:"open_body"`              // 熔断期间直接返回的响应体
+}
+
+// ErrorResponse 自定义错误响应，body 和 headers 的值中可以使用 {reason}、{request_id} 占位符
+type ErrorResponse struct {
+	StatusCode uint32            `json:"status_code"` // 默认 500
+	Headers    map[string]string `json:"headers"`
+	Body       string            `json:"body"`
+}
+
 type TokenInjection struct {
 	Type   string `json:"type"` // header, form_body
 	Key    string `json:"key"`
@@ -97,14 +238,276 @@ func CreateClusterClient(json gjson.Result) (wrapper.HttpClient, error) {
 	}
 }
 
+// validateGrantType 校验授权模式相关配置，并补齐默认值
+func validateGrantType(tokenConfig *TokenConfig) error {
+	switch tokenConfig.GrantType {
+	case "":
+		return nil
+	case GrantTypeClientCredentials:
+		credential := &tokenConfig.Credential
+		if credential.ClientID == "" || credential.ClientSecret == "" {
+			return fmt.Errorf("grant_type %s requires credential.client_id and credential.client_secret", GrantTypeClientCredentials)
+		}
+		switch credential.AuthMethod {
+		case "":
+			credential.AuthMethod = AuthMethodClientSecretBasic
+		case AuthMethodClientSecretBasic, AuthMethodClientSecretPost:
+		default:
+			return fmt.Errorf("unsupported credential.auth_method: %s", credential.AuthMethod)
+		}
+		return nil
+	default:
+		return fmt.Errorf("unsupported grant_type: %s", tokenConfig.GrantType)
+	}
+}
+
+// validateTokenExtraction 校验 Token 及其他值的提取配置，并补齐默认值
+func validateTokenExtraction(extraction *TokenExtraction) error {
+	if err := validateValueExtraction("token_extraction", &extraction.ValueExtraction); err != nil {
+		return err
+	}
+	if err := validatePath("token_extraction.expires_in_path", extraction.ExpiresInPath); err != nil {
+		return err
+	}
+
+	for name, value := range extraction.Values {
+		field := "token_extraction.values." + name
+		if name == PlaceholderToken || name == PlaceholderTokenType {
+			return fmt.Errorf("%s: name %q is reserved", field, name)
+		}
+		if value.Source == "" || value.Source == TokenSourceBody {
+			if value.ResponsePath == "" {
+				return fmt.Errorf("%s.response_path is required", field)
+			}
+		}
+		if err := validateValueExtraction(field, &value); err != nil {
+			return err
+		}
+		extraction.Values[name] = value
+	}
+	return nil
+}
+
+// validateValueExtraction 校验单个值的提取位置
+func validateValueExtraction(field string, extraction *ValueExtraction) error {
+	if err := validatePath(field+".response_path", extraction.ResponsePath); err != nil {
+		return err
+	}
+
+	switch extraction.Source {
+	case "":
+		extraction.Source = TokenSourceBody
+	case TokenSourceBody:
+	case TokenSourceHeader:
+		if extraction.HeaderName == "" {
+			return fmt.Errorf("%s.header_name is required when source is %s", field, TokenSourceHeader)
+		}
+	case TokenSourceCookie:
+		if extraction.CookieName == "" {
+			return fmt.Errorf("%s.cookie_name is required when source is %s", field, TokenSourceCookie)
+		}
+	default:
+		return fmt.Errorf("unsupported %s.source: %s", field, extraction.Source)
+	}
+	return nil
+}
+
+// parseValueExtraction 解析值的提取位置，字符串形式等价于 {response_path: <字符串>}
+func parseValueExtraction(json gjson.Result) ValueExtraction {
+	if json.Type == gjson.String {
+		return ValueExtraction{ResponsePath: json.String()}
+	}
+	return ValueExtraction{
+		Source:       json.Get("source").String(),
+		HeaderName:   json.Get("header_name").String(),
+		CookieName:   json.Get("cookie_name").String(),
+		ResponsePath: json.Get("response_path").String(),
+	}
+}
+
+// parseFetchRetry 解析 token 服务重试策略，未配置的字段使用默认值
+func parseFetchRetry(json gjson.Result) (FetchRetry, error) {
+	fetchRetry := FetchRetry{
+		MaxAttempts:       1,
+		RetryableStatuses: []int{429, 500, 502, 503, 504},
+		RetryableErrors:   []string{FetchErrorTimeout},
+	}
+	backoff, err := parseBackoff("token_fetch_retry", json, Backoff{BaseDelay: 100, MaxDelay: 2000, Jitter: 0.2})
+	if err != nil {
+		return fetchRetry, err
+	}
+	fetchRetry.Backoff = backoff
+	if !json.Exists() {
+		return fetchRetry, nil
+	}
+
+	if v := json.Get("max_attempts"); v.Exists() {
+		fetchRetry.MaxAttempts = int(v.Int())
+	}
+	if v := json.Get("retryable_statuses"); v.Exists() {
+		fetchRetry.RetryableStatuses = nil
+		for _, status := range v.Array() {
+			fetchRetry.RetryableStatuses = append(fetchRetry.RetryableStatuses, int(status.Int()))
+		}
+	}
+	if v := json.Get("retryable_errors"); v.Exists() {
+		fetchRetry.RetryableErrors = nil
+		for _, kind := range v.Array() {
+			switch kind.String() {
+			case FetchErrorTimeout, FetchErrorDispatchFailed:
+				fetchRetry.RetryableErrors = append(fetchRetry.RetryableErrors, kind.String())
+			default:
+				return fetchRetry, fmt.Errorf("unsupported token_fetch_retry.retryable_errors: %s", kind.String())
+			}
+		}
+	}
+
+	if fetchRetry.MaxAttempts < 1 {
+		return fetchRetry, fmt.Errorf("token_fetch_retry.max_attempts must be at least 1")
+	}
+	return fetchRetry, nil
+}
+
+// parseBackoff 解析 field 下的 base_delay、max_delay、jitter，未配置的字段使用 defaults
+func parseBackoff(field string, json gjson.Result, defaults Backoff) (Backoff, error) {
+	backoff := defaults
+	if v := json.Get("base_delay"); v.Exists() {
+		backoff.BaseDelay = uint32(v.Uint())
+	}
+	if v := json.Get("max_delay"); v.Exists() {
+		backoff.MaxDelay = uint32(v.Uint())
+	}
+	if v := json.Get("jitter"); v.Exists() {
+		backoff.Jitter = v.Float()
+	}
+
+	if backoff.Jitter < 0 || backoff.Jitter > 1 {
+		return backoff, fmt.Errorf("%s.jitter must be between 0 and 1", field)
+	}
+	if backoff.MaxDelay < backoff.BaseDelay {
+		backoff.MaxDelay = backoff.BaseDelay
+	}
+	return backoff, nil
+}
+
+// parseCircuitBreaker 解析 token 服务熔断配置，未配置的字段使用默认值
+func parseCircuitBreaker(json gjson.Result) (CircuitBreaker, error) {
+	breaker := CircuitBreaker{
+		FailureRateThreshold: 0.5,
+		MinimumRequests:      5,
+		Window:               60,
+		Cooldown:             30,
+		OpenStatusCode:       503,
+		OpenBody:             "Token service unavailable",
+	}
+	if !json.Exists() {
+		return breaker, nil
+	}
+
+	breaker.Enabled = json.Get("enabled").Bool()
+	if v := json.Get("failure_rate_threshold"); v.Exists() {
+		breaker.FailureRateThreshold = v.Float()
+	}
+	if v := json.Get("minimum_requests"); v.Exists() {
+		breaker.MinimumRequests = int(v.Int())
+	}
+	if v := json.Get("window"); v.Exists() {
+		breaker.Window = v.Int()
+	}
+	if v := json.Get("cooldown"); v.Exists() {
+		breaker.Cooldown = v.Int()
+	}
+	if v := json.Get("open_status_code"); v.Exists() {
+		breaker.OpenStatusCode = uint32(v.Uint())
+	}
+	if v := json.Get("open_body"); v.Exists() {
+		breaker.OpenBody = v.String()
+	}
+
+	if breaker.FailureRateThreshold <= 0 || breaker.FailureRateThreshold > 1 {
+		return breaker, fmt.Errorf("circuit_breaker.failure_rate_threshold must be in (0, 1]")
+	}
+	if breaker.MinimumRequests < 1 {
+		return breaker, fmt.Errorf("circuit_breaker.minimum_requests must be at least 1")
+	}
+	if breaker.Window <= 0 || breaker.Cooldown <= 0 {
+		return breaker, fmt.Errorf("circuit_breaker.window and circuit_breaker.cooldown must be greater than 0")
+	}
+	if breaker.OpenStatusCode < 100 || breaker.OpenStatusCode > 599 {
+		return breaker, fmt.Errorf("circuit_breaker.open_status_code must be a valid HTTP status")
+	}
+	return breaker, nil
+}
+
+// compileCondition 编译条件表达式，表达式为空时返回 nil
+func compileCondition(field string, source string) (*condition.Program, error) {
+	if source == "" {
+		return nil, nil
+	}
+	program, err := condition.Compile(source)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s %q: %v", field, source, err)
+	}
+	return program, nil
+}
+
+// parseErrorResponses 解析 error_responses，只接受已知的失败类型
+func parseErrorResponses(json gjson.Result) (map[string]ErrorResponse, error) {
+	if !json.Exists() {
+		return nil, nil
+	}
+	if !json.IsObject() {
+		return nil, fmt.Errorf("error_responses must be an object")
+	}
+
+	responses := make(map[string]ErrorResponse)
+	var err error
+	json.ForEach(func(key, value gjson.Result) bool {
+		kind := key.String()
+		switch kind {
+		case ErrorKindFetchFailed, ErrorKindEmptyToken, ErrorKindRetryFailed, ErrorKindRetriesExhausted:
+		default:
+			err = fmt.Errorf("unsupported error_responses kind: %s", kind)
+			return false
+		}
+
+		response := ErrorResponse{
+			StatusCode: 500,
+			Body:       value.Get("body").String(),
+		}
+		if statusCode := value.Get("status_code"); statusCode.Exists() {
+			response.StatusCode = uint32(statusCode.Uint())
+		}
+		if response.StatusCode < 100 || response.StatusCode > 599 {
+			err = fmt.Errorf("error_responses.%s.status_code must be a valid HTTP status", kind)
+			return false
+		}
+		if headers := value.Get("headers"); headers.Exists() {
+			response.Headers = make(map[string]string)
+			headers.ForEach(func(name, value gjson.Result) bool {
+				response.Headers[strings.ToLower(name.String())] = value.String()
+				return true
+			})
+		}
+		responses[kind] = response
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	return responses, nil
+}
+
 // ... existing code ...
 func ParseConfig(json gjson.Result, config *SimpleConfig) error {
 	// Parse token config
 	tokenConfig := json.Get("token_config")
 	if tokenConfig.Exists() {
 		config.TokenConfig.Enabled = tokenConfig.Get("enabled").Bool()
+		config.TokenConfig.GrantType = tokenConfig.Get("grant_type").String()
 		config.TokenConfig.TokenPath = tokenConfig.Get("token_path").String()
 		config.TokenConfig.Timeout = uint32(tokenConfig.Get("timeout").Uint())
+		config.TokenConfig.ProviderID = tokenConfig.Get("provider_id").String()
 
 		// Parse credential
 		credential := tokenConfig.Get("credential")
@@ -128,12 +531,37 @@ func ParseConfig(json gjson.Result, config *SimpleConfig) error {
 					return true
 				})
 			}
+
+			config.TokenConfig.Credential.ClientID = credential.Get("client_id").String()
+			config.TokenConfig.Credential.ClientSecret = credential.Get("client_secret").String()
+			config.TokenConfig.Credential.AuthMethod = credential.Get("auth_method").String()
+			config.TokenConfig.Credential.Scope = credential.Get("scope").String()
+			config.TokenConfig.Credential.Audience = credential.Get("audience").String()
+		}
+
+		if err := validateGrantType(&config.TokenConfig); err != nil {
+			return err
 		}
 
 		// Parse token extraction
 		tokenExtraction := tokenConfig.Get("token_extraction")
 		if tokenExtraction.Exists() {
-			config.TokenConfig.TokenExtraction.ResponsePath = tokenExtraction.Get("response_path").String()
+			config.TokenConfig.TokenExtraction.ValueExtraction = parseValueExtraction(tokenExtraction)
+			config.TokenConfig.TokenExtraction.ExpiresInPath = tokenExtraction.Get("expires_in_path").String()
+			config.TokenConfig.TokenExtraction.ExpiryFromJwt = tokenExtraction.Get("expiry_from_jwt").Bool()
+
+			values := tokenExtraction.Get("values")
+			if values.Exists() {
+				config.TokenConfig.TokenExtraction.Values = make(map[string]ValueExtraction)
+				values.ForEach(func(key, value gjson.Result) bool {
+					config.TokenConfig.TokenExtraction.Values[key.String()] = parseValueExtraction(value)
+					return true
+				})
+			}
+		}
+
+		if err := validateTokenExtraction(&config.TokenConfig.TokenExtraction); err != nil {
+			return err
 		}
 
 		// Parse token injection
@@ -156,6 +584,119 @@ func ParseConfig(json gjson.Result, config *SimpleConfig) error {
 	if invalidTokenCondition.Exists() {
 		config.TokenConfig.InvalidTokenCondition = invalidTokenCondition.String()
 	}
+	invalidTokenProgram, err := compileCondition("invalid_token_condition", config.TokenConfig.InvalidTokenCondition)
+	if err != nil {
+		return err
+	}
+	config.TokenConfig.InvalidTokenProgram = invalidTokenProgram
+
+	config.TokenConfig.TokenSuccessCondition = tokenConfig.Get("token_success_condition").String()
+	tokenSuccessProgram, err := compileCondition("token_success_condition", config.TokenConfig.TokenSuccessCondition)
+	if err != nil {
+		return err
+	}
+	config.TokenConfig.TokenSuccessProgram = tokenSuccessProgram
+	config.TokenConfig.TokenErrorMessagePath = tokenConfig.Get("token_error_message_path").String()
+	if err := validatePath("token_error_message_path", config.TokenConfig.TokenErrorMessagePath); err != nil {
+		return err
+	}
+
+	config.TokenConfig.RefreshSkew = DefaultRefreshSkew
+	refreshSkew := tokenConfig.Get("refresh_skew")
+	if refreshSkew.Exists() {
+		config.TokenConfig.RefreshSkew = refreshSkew.Int()
+	}
+
+	config.TokenConfig.MaxPendingRequests = DefaultMaxPendingRequests
+	maxPendingRequests := tokenConfig.Get("max_pending_requests")
+	if maxPendingRequests.Exists() {
+		config.TokenConfig.MaxPendingRequests = int(maxPendingRequests.Int())
+		if config.TokenConfig.MaxPendingRequests <= 0 {
+			return fmt.Errorf("max_pending_requests must be greater than 0")
+		}
+	}
+
+	fetchRetry, err := parseFetchRetry(tokenConfig.Get("token_fetch_retry"))
+	if err != nil {
+		return err
+	}
+	config.TokenConfig.FetchRetry = fetchRetry
+
+	circuitBreaker, err := parseCircuitBreaker(tokenConfig.Get("circuit_breaker"))
+	if err != nil {
+		return err
+	}
+	config.TokenConfig.CircuitBreaker = circuitBreaker
+
+	config.TokenConfig.StaleWhileRevalidate = tokenConfig.Get("stale_while_revalidate").Int()
+	config.TokenConfig.StaleIfError = tokenConfig.Get("stale_if_error").Int()
+	if config.TokenConfig.StaleWhileRevalidate < 0 || config.TokenConfig.StaleIfError < 0 {
+		return fmt.Errorf("stale_while_revalidate and stale_if_error must not be negative")
+	}
+
+	config.TokenConfig.OnTokenFailure = tokenConfig.Get("on_token_failure").String()
+	switch config.TokenConfig.OnTokenFailure {
+	case "":
+		config.TokenConfig.OnTokenFailure = OnTokenFailureDeny
+	case OnTokenFailureDeny, OnTokenFailureAllow, OnTokenFailureAllowWithHeader:
+	default:
+		return fmt.Errorf("unsupported on_token_failure: %s", config.TokenConfig.OnTokenFailure)
+	}
+
+	errorResponses, err := parseErrorResponses(tokenConfig.Get("error_responses"))
+	if err != nil {
+		return err
+	}
+	config.TokenConfig.ErrorResponses = errorResponses
+
+	// 未配置时：配置了 error_responses.retries_exhausted 就返回该响应，否则原样返回上游响应
+	config.TokenConfig.OnRetriesExhausted = tokenConfig.Get("on_retries_exhausted").String()
+	switch config.TokenConfig.OnRetriesExhausted {
+	case "":
+		config.TokenConfig.OnRetriesExhausted = OnRetriesExhaustedPassthrough
+		if _, ok := errorResponses[ErrorKindRetriesExhausted]; ok {
+			config.TokenConfig.OnRetriesExhausted = OnRetriesExhaustedError
+		}
+	case OnRetriesExhaustedPassthrough, OnRetriesExhaustedError:
+	default:
+		return fmt.Errorf("unsupported on_retries_exhausted: %s", config.TokenConfig.OnRetriesExhausted)
+	}
+
+	config.TokenConfig.RetryTimeout = DefaultRetryTimeout
+	if retryTimeout := tokenConfig.Get("retry_timeout"); retryTimeout.Exists() {
+		config.TokenConfig.RetryTimeout = uint32(retryTimeout.Uint())
+		if config.TokenConfig.RetryTimeout == 0 {
+			return fmt.Errorf("retry_timeout must be greater than 0")
+		}
+	}
+	retryBackoff, err := parseBackoff("retry_backoff", tokenConfig.Get("retry_backoff"), Backoff{MaxDelay: 2000})
+	if err != nil {
+		return err
+	}
+	config.TokenConfig.RetryBackoff = retryBackoff
+	config.TokenConfig.RetryDeadline = uint32(tokenConfig.Get("retry_deadline").Uint())
+	config.TokenConfig.RetryMarkerHeader = strings.ToLower(tokenConfig.Get("retry_marker_header").String())
+
+	config.TokenConfig.InspectMediaTypes = mediatype.DefaultPatterns
+	if inspectMediaTypes := tokenConfig.Get("inspect_media_types"); inspectMediaTypes.Exists() {
+		config.TokenConfig.InspectMediaTypes = nil
+		for _, v := range inspectMediaTypes.Array() {
+			config.TokenConfig.InspectMediaTypes = append(config.TokenConfig.InspectMediaTypes, v.String())
+		}
+	}
+	inspectMatcher, err := mediatype.NewMatcher(config.TokenConfig.InspectMediaTypes)
+	if err != nil {
+		return fmt.Errorf("inspect_media_types: %v", err)
+	}
+	config.TokenConfig.InspectMatcher = inspectMatcher
+
+	config.TokenConfig.MaxInspectBodySize = DefaultMaxInspectBodySize
+	if maxInspectBodySize := tokenConfig.Get("max_inspect_body_size"); maxInspectBodySize.Exists() {
+		if maxInspectBodySize.Int() <= 0 {
+			return fmt.Errorf("max_inspect_body_size must be greater than 0")
+		}
+		config.TokenConfig.MaxInspectBodySize = uint32(maxInspectBodySize.Uint())
+	}
 
 	retry_send_times := tokenConfig.Get("retry_send_times")
 	if retry_send_times.Exists() {
@@ -196,5 +737,73 @@ func ParseConfig(json gjson.Result, config *SimpleConfig) error {
 
 		}
 	}
+
+	config.TokenConfig.CacheKey = tokenCacheKey(config)
 	return nil
 }
+
+// tokenCacheKey 计算 Token 缓存标识，token 服务地址、凭证或提取方式不同的配置不会共用 Token
+func tokenCacheKey(config *SimpleConfig) string {
+	if config.TokenConfig.ProviderID != "" {
+		return config.TokenConfig.ProviderID
+	}
+
+	cluster := ""
+	if config.TokenService.Client != nil {
+		cluster = config.TokenService.Client.ClusterName()
+	}
+	credential := config.TokenConfig.Credential
+	parts := []string{
+		cluster,
+		config.TokenConfig.TokenPath,
+		config.TokenConfig.GrantType,
+		credential.ClientID,
+		credential.ClientSecret,
+		credential.AuthMethod,
+		credential.Scope,
+		credential.Audience,
+		sortedFields(credential.FormFields),
+		sortedFields(credential.HeadFields),
+		extractionKey(config.TokenConfig.TokenExtraction),
+	}
+	sum := sha256.Sum256([]byte(strings.Join(parts, "\n")))
+	return hex.EncodeToString(sum[:8])
+}
+
+// extractionKey 把 token_extraction 拼接成字符串，values 按名称排序
+func extractionKey(extraction TokenExtraction) string {
+	names := make([]string, 0, len(extraction.Values))
+	for name := range extraction.Values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var b strings.Builder
+	writeValue := func(name string, value ValueExtraction) {
+		fmt.Fprintf(&b, "%q:%q,%q,%q,%q;", name, value.Source, value.HeaderName, value.CookieName, value.ResponsePath)
+	}
+	writeValue("", extraction.ValueExtraction)
+	fmt.Fprintf(&b, "%q,%t;", extraction.ExpiresInPath, extraction.ExpiryFromJwt)
+	for _, name := range names {
+		writeValue(name, extraction.Values[name])
+	}
+	return b.String()
+}
+
+// sortedFields 把 map 按键排序后拼接，保证相同配置得到相同结果
+func sortedFields(fields map[string]string) string {
+	keys := make([]string, 0, len(fields))
+	for k := range fields {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var b strings.Builder
+	for _, k := range keys {
+		b.WriteString(k)
+		b.WriteByte('=')
+		b.WriteString(fields[k])
+		b.WriteByte('&')
+	}
+	return b.String()
+}
@@ -0,0 +1,79 @@
+package config
+
+import "testing"
+
+func TestTokenCacheKeyIncludesExtraction(t *testing.T) {
+	newConfig := func(extraction TokenExtraction) *SimpleConfig {
+		return &SimpleConfig{TokenConfig: TokenConfig{
+			TokenPath:       "/oauth/token",
+			Credential:      Credential{ClientID: "id", ClientSecret: "secret"},
+			TokenExtraction: extraction,
+		}}
+	}
+	base := TokenExtraction{
+		ValueExtraction: ValueExtraction{Source: "body", ResponsePath: "access_token"},
+		Values: map[string]ValueExtraction{
+			"tenant": {Source: "body", ResponsePath: "tenant_id"},
+			"region": {Source: "header", HeaderName: "x-region"},
+		},
+	}
+	baseKey := tokenCacheKey(newConfig(base))
+
+	same := base
+	same.Values = map[string]ValueExtraction{
+		"region": {Source: "header", HeaderName: "x-region"},
+		"tenant": {Source: "body", ResponsePath: "tenant_id"},
+	}
+	if got := tokenCacheKey(newConfig(same)); got != baseKey {
+		t.Errorf("same extraction gave key %q, want %q", got, baseKey)
+	}
+
+	tests := []struct {
+		name   string
+		modify func(*TokenExtraction)
+	}{
+		{"response path", func(e *TokenExtraction) { e.ResponsePath = "data.token" }},
+		{"header source", func(e *TokenExtraction) { e.Source, e.HeaderName, e.ResponsePath = "header", "x-token", "" }},
+		{"cookie source", func(e *TokenExtraction) { e.Source, e.CookieName, e.ResponsePath = "cookie", "session", "" }},
+		{"expires in path", func(e *TokenExtraction) { e.ExpiresInPath = "expires_in" }},
+		{"expiry from jwt", func(e *TokenExtraction) { e.ExpiryFromJwt = true }},
+		{"extra value", func(e *TokenExtraction) {
+			e.Values = map[string]ValueExtraction{
+				"tenant": {Source: "body", ResponsePath: "tenant_id"},
+				"region": {Source: "header", HeaderName: "x-region"},
+				"user":   {Source: "body", ResponsePath: "user_id"},
+			}
+		}},
+		{"value path", func(e *TokenExtraction) {
+			e.Values = map[string]ValueExtraction{
+				"tenant": {Source: "body", ResponsePath: "data.tenant_id"},
+				"region": {Source: "header", HeaderName: "x-region"},
+			}
+		}},
+		{"value renamed", func(e *TokenExtraction) {
+			e.Values = map[string]ValueExtraction{
+				"org":    {Source: "body", ResponsePath: "tenant_id"},
+				"region": {Source: "header", HeaderName: "x-region"},
+			}
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			extraction := base
+			tt.modify(&extraction)
+			if got := tokenCacheKey(newConfig(extraction)); got == baseKey {
+				t.Errorf("changing %s did not change the cache key", tt.name)
+			}
+		})
+	}
+}
+
+func TestTokenCacheKeyProviderID(t *testing.T) {
+	config := &SimpleConfig{TokenConfig: TokenConfig{
+		ProviderID:      "shared-provider",
+		TokenExtraction: TokenExtraction{ValueExtraction: ValueExtraction{ResponsePath: "token"}},
+	}}
+	if got := tokenCacheKey(config); got != "shared-provider" {
+		t.Errorf("tokenCacheKey() = %q, want provider_id", got)
+	}
+}
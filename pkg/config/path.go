@@ -0,0 +1,57 @@
+package config
+
+import (
+	"fmt"
+)
+
+// validatePath 检查 gjson 路径中的括号是否配对、查询条件中的字符串和转义是否完整，
+// 配置阶段给出可读的错误而不是运行时提取失败；不校验 gjson 的其他语法
+func validatePath(field string, path string) error {
+	if path == "" {
+		return nil
+	}
+
+	var stack []byte
+	for i := 0; i < len(path); i++ {
+		c := path[i]
+		switch c {
+		case '\\':
+			if i == len(path)-1 {
+				return fmt.Errorf("%s: path %q ends with an unfinished escape", field, path)
+			}
+			i++
+		case '"':
+			if len(stack) == 0 {
+				continue
+			}
+			// 查询条件中的字符串字面量，跳到对应的结束引号
+			end := i + 1
+			for ; end < len(path); end++ {
+				if path[end] == '\\' {
+					end++
+					continue
+				}
+				if path[end] == '"' {
+					break
+				}
+			}
+			if end >= len(path) {
+				return fmt.Errorf("%s: path %q has an unterminated string at position %d", field, path, i)
+			}
+			i = end
+		case '(', '[', '{':
+			stack = append(stack, c)
+		case ')', ']', '}':
+			open := map[byte]byte{')': '(', ']': '[', '}': '{'}[c]
+			if len(stack) == 0 || stack[len(stack)-1] != open {
+				return fmt.Errorf("%s: path %q has unexpected %q at position %d", field, path, c, i)
+			}
+			stack = stack[:len(stack)-1]
+		}
+	}
+
+	if len(stack) > 0 {
+		return fmt.Errorf("%s: path %q has unclosed %q", field, path, stack[len(stack)-1])
+	}
+	return nil
+}
@@ -0,0 +1,45 @@
+package config
+
+import "testing"
+
+func TestValidatePath(t *testing.T) {
+	tests := []struct {
+		path    string
+		wantErr bool
+	}{
+		{"", false},
+		{"access_token", false},
+		{"data.tokens.0.value", false},
+		{"data.tokens.#", false},
+		{`result.#(type=="access").token`, false},
+		{`friends.#(last=="Murphy")#.first`, false},
+		{`friends.#(nets.#(=="fb"))#.first`, false},
+		{`items.#(name%"a*")`, false},
+		{`#(msg=="a)b").id`, false},
+		{`#(msg=="say \"hi\"").id`, false},
+		{"a|@reverse", false},
+		{"@this", false},
+		{"{token:access_token,type:token_type}", false},
+		{"[access_token,token_type]", false},
+		{`fav\.movie`, false},
+		{"..#", false},
+		{"..0", false},
+		{"..#.name", false},
+		{"..0.access_token", false},
+
+		{"a(b", true},
+		{"a)b", true},
+		{"[a,b", true},
+		{"{a,b]", true},
+		{`#(type=="access).token`, true},
+		{`fav\`, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			err := validatePath("token_extraction.response_path", tt.path)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("validatePath(%q) error = %v, wantErr %v", tt.path, err, tt.wantErr)
+			}
+		})
+	}
+}
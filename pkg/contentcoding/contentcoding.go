@@ -0,0 +1,76 @@
+package contentcoding
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/andybalholm/brotli"
+)
+
+// DefaultMaxDecodedSize 解码后响应体的默认上限，防止压缩炸弹占满 Wasm 内存
+const DefaultMaxDecodedSize = 4 << 20
+
+// Decode 按 content-encoding 解码响应体，多个编码按应用顺序的逆序解码
+// content-encoding 为空或 identity 时原样返回；解码结果超过 maxSize 时返回错误
+func Decode(contentEncoding string, body []byte, maxSize int) ([]byte, error) {
+	applied := codings(contentEncoding)
+	for i := len(applied) - 1; i >= 0; i-- {
+		decoded, err := decodeOne(applied[i], body, maxSize)
+		if err != nil {
+			return nil, fmt.Errorf("decode %s: %w", applied[i], err)
+		}
+		body = decoded
+	}
+	return body, nil
+}
+
+// codings 解析 content-encoding，去掉 identity
+func codings(contentEncoding string) []string {
+	var result []string
+	for _, coding := range strings.Split(contentEncoding, ",") {
+		coding = strings.ToLower(strings.TrimSpace(coding))
+		if coding != "" && coding != "identity" {
+			result = append(result, coding)
+		}
+	}
+	return result
+}
+
+func decodeOne(coding string, body []byte, maxSize int) ([]byte, error) {
+	var reader io.Reader
+	switch coding {
+	case "gzip", "x-gzip":
+		r, err := gzip.NewReader(bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		defer r.Close()
+		reader = r
+	case "deflate":
+		// 按 RFC 9110 应为 zlib 格式，部分服务直接返回原始 deflate 数据
+		r, err := zlib.NewReader(bytes.NewReader(body))
+		if err != nil {
+			r = flate.NewReader(bytes.NewReader(body))
+		}
+		defer r.Close()
+		reader = r
+	case "br":
+		reader = brotli.NewReader(bytes.NewReader(body))
+	default:
+		return nil, fmt.Errorf("unsupported content-encoding")
+	}
+
+	decoded, err := io.ReadAll(io.LimitReader(reader, int64(maxSize)+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(decoded) > maxSize {
+		return nil, fmt.Errorf("decoded body exceeds %d bytes", maxSize)
+	}
+	return decoded, nil
+}
@@ -0,0 +1,94 @@
+package contentcoding
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/andybalholm/brotli"
+)
+
+// compress 用 newWriter 压缩 data
+func compress(t *testing.T, data []byte, newWriter func(io.Writer) io.WriteCloser) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	w := newWriter(&buf)
+	if _, err := w.Write(data); err != nil {
+		t.Fatalf("compress: %v", err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("compress: %v", err)
+	}
+	return buf.Bytes()
+}
+
+func gzipWriter(w io.Writer) io.WriteCloser { return gzip.NewWriter(w) }
+
+func zlibWriter(w io.Writer) io.WriteCloser { return zlib.NewWriter(w) }
+
+func flateWriter(w io.Writer) io.WriteCloser {
+	fw, _ := flate.NewWriter(w, flate.DefaultCompression)
+	return fw
+}
+
+func brotliWriter(w io.Writer) io.WriteCloser { return brotli.NewWriter(w) }
+
+func TestDecode(t *testing.T) {
+	plain := []byte(`{"code":401,"msg":"token expired"}`)
+	tests := []struct {
+		name     string
+		encoding string
+		body     []byte
+	}{
+		{"no encoding", "", plain},
+		{"identity", "identity", plain},
+		{"gzip", "gzip", compress(t, plain, gzipWriter)},
+		{"x-gzip", "x-gzip", compress(t, plain, gzipWriter)},
+		{"deflate zlib", "deflate", compress(t, plain, zlibWriter)},
+		{"deflate raw", "deflate", compress(t, plain, flateWriter)},
+		{"br", "br", compress(t, plain, brotliWriter)},
+		{"upper case", "GZIP", compress(t, plain, gzipWriter)},
+		{"applied in order", "gzip, br", compress(t, compress(t, plain, gzipWriter), brotliWriter)},
+		{"identity in list", "identity, gzip", compress(t, plain, gzipWriter)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Decode(tt.encoding, tt.body, DefaultMaxDecodedSize)
+			if err != nil {
+				t.Fatalf("Decode(%q) error = %v", tt.encoding, err)
+			}
+			if !bytes.Equal(got, plain) {
+				t.Errorf("Decode(%q) = %q, want %q", tt.encoding, got, plain)
+			}
+		})
+	}
+}
+
+func TestDecodeErrors(t *testing.T) {
+	large := []byte(strings.Repeat("a", 1024))
+	tests := []struct {
+		name     string
+		encoding string
+		body     []byte
+		maxSize  int
+	}{
+		{"unsupported", "zstd", []byte("data"), DefaultMaxDecodedSize},
+		{"corrupt gzip", "gzip", []byte("not gzip"), DefaultMaxDecodedSize},
+		{"exceeds max size", "gzip", compress(t, large, gzipWriter), len(large) - 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := Decode(tt.encoding, tt.body, tt.maxSize); err == nil {
+				t.Errorf("Decode(%q) error = nil, want error", tt.encoding)
+			}
+		})
+	}
+
+	if got, err := Decode("gzip", compress(t, large, gzipWriter), len(large)); err != nil || len(got) != len(large) {
+		t.Errorf("Decode at exactly max size: len = %d, err = %v", len(got), err)
+	}
+}
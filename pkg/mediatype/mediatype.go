@@ -0,0 +1,87 @@
+package mediatype
+
+import (
+	"fmt"
+	"mime"
+	"strings"
+)
+
+// DefaultPatterns 默认检查的响应类型：JSON 及所有 +json 结构化后缀类型（如 application/problem+json）
+var DefaultPatterns = []string{"application/json", "text/json", "*/*+json"}
+
+// pattern 一条媒体类型规则，type 或 subtype 为 * 时匹配任意值，suffix 不为空时只比较结构化后缀
+type pattern struct {
+	typ     string
+	subtype string
+	suffix  string
+}
+
+// Matcher 按规则匹配 content-type，忽略大小写和参数（如 charset）
+type Matcher struct {
+	patterns []pattern
+}
+
+// NewMatcher 解析媒体类型规则，支持 type/subtype、type/*、type/*+suffix、*/*+suffix
+func NewMatcher(patterns []string) (*Matcher, error) {
+	m := &Matcher{}
+	for _, raw := range patterns {
+		p, err := parsePattern(raw)
+		if err != nil {
+			return nil, err
+		}
+		m.patterns = append(m.patterns, p)
+	}
+	return m, nil
+}
+
+func parsePattern(raw string) (pattern, error) {
+	value := strings.ToLower(strings.TrimSpace(raw))
+	typ, subtype, ok := strings.Cut(value, "/")
+	if !ok || typ == "" || subtype == "" || strings.ContainsAny(value, ";, ") {
+		return pattern{}, fmt.Errorf("invalid media type pattern %q", raw)
+	}
+	p := pattern{typ: typ, subtype: subtype}
+	if strings.HasPrefix(subtype, "*+") {
+		p.subtype = "*"
+		p.suffix = subtype[2:]
+		if p.suffix == "" {
+			return pattern{}, fmt.Errorf("invalid media type pattern %q", raw)
+		}
+	}
+	if typ == "*" && p.subtype != "*" {
+		return pattern{}, fmt.Errorf("invalid media type pattern %q", raw)
+	}
+	return p, nil
+}
+
+// Match content-type 是否匹配任意一条规则，content-type 为空或无法解析时返回 false
+func (m *Matcher) Match(contentType string) bool {
+	if m == nil || contentType == "" {
+		return false
+	}
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil && mediaType == "" {
+		// 参数格式错误时 ParseMediaType 仍会返回媒体类型，只有类型本身无法解析才放弃
+		return false
+	}
+	typ, subtype, ok := strings.Cut(mediaType, "/")
+	if !ok {
+		return false
+	}
+
+	for _, p := range m.patterns {
+		if p.typ != "*" && p.typ != typ {
+			continue
+		}
+		if p.suffix != "" {
+			if strings.HasSuffix(subtype, "+"+p.suffix) {
+				return true
+			}
+			continue
+		}
+		if p.subtype == "*" || p.subtype == subtype {
+			return true
+		}
+	}
+	return false
+}
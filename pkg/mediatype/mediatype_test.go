@@ -0,0 +1,70 @@
+package mediatype
+
+import "testing"
+
+func TestNewMatcherPatterns(t *testing.T) {
+	tests := []struct {
+		pattern string
+		wantErr bool
+	}{
+		{"application/json", false},
+		{" application/json ", false},
+		{"\tText/*\n", false},
+		{"*/*+json", false},
+		{"application/*+xml", false},
+		{"*/*", false},
+
+		{"", true},
+		{"application", true},
+		{"application/", true},
+		{"/json", true},
+		{"application/json; charset=utf-8", true},
+		{"application/json,text/json", true},
+		{"application /json", true},
+		{"application/*+", true},
+		{"*/json", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.pattern, func(t *testing.T) {
+			_, err := NewMatcher([]string{tt.pattern})
+			if (err != nil) != tt.wantErr {
+				t.Errorf("NewMatcher(%q) error = %v, wantErr %v", tt.pattern, err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestMatcherMatch(t *testing.T) {
+	m, err := NewMatcher(DefaultPatterns)
+	if err != nil {
+		t.Fatalf("NewMatcher(DefaultPatterns) error = %v", err)
+	}
+	tests := []struct {
+		contentType string
+		want        bool
+	}{
+		{"application/json", true},
+		{"Application/JSON; charset=UTF-8", true},
+		{"text/json", true},
+		{"application/problem+json", true},
+		{"application/vnd.api+json; charset=utf-8", true},
+		{"application/json; charset", true},
+		{"text/html", false},
+		{"application/jsonp", false},
+		{"application/octet-stream", false},
+		{"", false},
+		{"json", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.contentType, func(t *testing.T) {
+			if got := m.Match(tt.contentType); got != tt.want {
+				t.Errorf("Match(%q) = %v, want %v", tt.contentType, got, tt.want)
+			}
+		})
+	}
+
+	var none *Matcher
+	if none.Match("application/json") {
+		t.Errorf("nil Matcher matched")
+	}
+}
@@ -0,0 +1,68 @@
+package retry
+
+import (
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// hopByHopHeaders 逐跳头，只对单个连接有效，不能转发给下游
+var hopByHopHeaders = map[string]bool{
+	"connection":          true,
+	"keep-alive":          true,
+	"proxy-connection":    true,
+	"proxy-authenticate":  true,
+	"proxy-authorization": true,
+	"te":                  true,
+	"trailer":             true,
+	"transfer-encoding":   true,
+	"upgrade":             true,
+}
+
+// replayResponseHeaders 把重放请求的响应头转换为返回给下游的响应头：
+// 保留每个头的所有值，去掉伪头和逐跳头（包括 Connection 中列出的头），按实际响应体重新计算 content-length，
+// markerHeader 不为空时加上该头，值为重放次数
+func replayResponseHeaders(headers http.Header, body []byte, markerHeader string, retryCount int) [][2]string {
+	// 响应头的键不一定是规范格式，不能用 headers.Values 查找
+	skip := make(map[string]bool)
+	for name, values := range headers {
+		if !strings.EqualFold(name, "connection") {
+			continue
+		}
+		for _, v := range values {
+			for _, listed := range strings.Split(v, ",") {
+				if listed = strings.TrimSpace(listed); listed != "" {
+					skip[strings.ToLower(listed)] = true
+				}
+			}
+		}
+	}
+
+	// 按名称排序，保证输出稳定
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var result [][2]string
+	for _, name := range names {
+		lower := strings.ToLower(name)
+		if strings.HasPrefix(lower, ":") || hopByHopHeaders[lower] || skip[lower] || lower == "content-length" {
+			continue
+		}
+		if markerHeader != "" && strings.EqualFold(lower, markerHeader) {
+			continue
+		}
+		for _, v := range headers[name] {
+			result = append(result, [2]string{lower, v})
+		}
+	}
+
+	result = append(result, [2]string{"content-length", strconv.Itoa(len(body))})
+	if markerHeader != "" {
+		result = append(result, [2]string{markerHeader, strconv.Itoa(retryCount)})
+	}
+	return result
+}
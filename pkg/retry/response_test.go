@@ -0,0 +1,45 @@
+package retry
+
+import (
+	"net/http"
+	"reflect"
+	"testing"
+)
+
+func TestReplayResponseHeaders(t *testing.T) {
+	headers := http.Header{
+		":status":            {"200"},
+		"Set-Cookie":         {"a=1", "b=2"},
+		"content-type":       {"application/json"},
+		"Connection":         {"keep-alive, X-Internal"},
+		"x-internal":         {"secret"},
+		"Transfer-Encoding":  {"chunked"},
+		"Content-Length":     {"999"},
+		"X-Ext-Auth-Retried": {"5"},
+	}
+	body := []byte(`{"ok":true}`)
+
+	got := replayResponseHeaders(headers, body, "x-ext-auth-retried", 2)
+	want := [][2]string{
+		{"set-cookie", "a=1"},
+		{"set-cookie", "b=2"},
+		{"content-type", "application/json"},
+		{"content-length", "11"},
+		{"x-ext-auth-retried", "2"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("replayResponseHeaders() = %v, want %v", got, want)
+	}
+}
+
+func TestReplayResponseHeadersWithoutMarker(t *testing.T) {
+	headers := http.Header{"X-Ext-Auth-Retried": {"1"}}
+	got := replayResponseHeaders(headers, nil, "", 3)
+	want := [][2]string{
+		{"x-ext-auth-retried", "1"},
+		{"content-length", "0"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("replayResponseHeaders() = %v, want %v", got, want)
+	}
+}
@@ -2,8 +2,12 @@ package retry
 
 import (
 	"bst-auth/pkg/config"
+	"bst-auth/pkg/scheduler"
 	"bst-auth/pkg/token"
+	"errors"
+	"fmt"
 	"net/http"
+	"time"
 
 	"github.com/higress-group/proxy-wasm-go-sdk/proxywasm"
 	"github.com/higress-group/proxy-wasm-go-sdk/proxywasm/types"
@@ -16,114 +20,284 @@ type RetryContext struct {
 	OriginalBody    []byte
 	RetryCount      int
 	MaxRetries      int
+	Deadline        time.Time // 所有重放的总时限，零值表示不限制，从第一次重试开始计算
+	Cluster         string    // 当前路由的上游集群，未配置 gateway_service 时直接重放到该集群
+}
+
+// deadlineExceeded 是否已超过 retry_deadline
+func (r *RetryContext) deadlineExceeded() bool {
+	return !r.Deadline.IsZero() && !time.Now().Before(r.Deadline)
 }
 
 const (
 	ContextKey = "retry-context"
 )
 
-func HandleRetryWithToken(ctx wrapper.HttpContext, config config.SimpleConfig, tm *token.TokenManager) types.Action {
+// replayStep 上游判定 token 无效后的下一步
+type replayStep int
+
+const (
+	stepForward   replayStep = iota // token 有效，把响应返回给下游
+	stepRetry                       // 刷新 token 后重放
+	stepExhausted                   // 重放次数或总时限已用尽，按 on_retries_exhausted 处理
+)
+
+// nextStep 根据响应中的 token 是否无效决定下一步
+func (r *RetryContext) nextStep(tokenInvalid bool) replayStep {
+	switch {
+	case !tokenInvalid:
+		return stepForward
+	case r.RetryCount < r.MaxRetries && !r.deadlineExceeded():
+		return stepRetry
+	default:
+		return stepExhausted
+	}
+}
+
+func HandleRetryWithToken(ctx wrapper.HttpContext, cfg config.SimpleConfig, tm *token.TokenManager) types.Action {
 	retryCtx, ok := ctx.GetContext(ContextKey).(*RetryContext)
 	if !ok {
 		log.Warn("Failed to get retry context")
 		return types.ActionContinue
 	}
 
-	if retryCtx.RetryCount >= retryCtx.MaxRetries {
+	if retryCtx.nextStep(true) == stepExhausted {
 		log.Infof("Max retries reached (%d), giving up", retryCtx.MaxRetries)
+		if sendRetriesExhausted(cfg.TokenConfig, retryCtx.MaxRetries) {
+			return types.ActionPause
+		}
 		return types.ActionContinue
 	}
 
+	if retryCtx.RetryCount == 0 && cfg.TokenConfig.RetryDeadline > 0 {
+		retryCtx.Deadline = time.Now().Add(time.Duration(cfg.TokenConfig.RetryDeadline) * time.Millisecond)
+	}
+	refreshAndReplay(ctx, cfg, tm, retryCtx)
+
+	// 🛑 暂停请求处理，等待 token 获取和重试完成
+	return types.ActionPause
+}
+
+// refreshAndReplay 刷新 token 后重放原始请求；重放的响应仍判定 token 无效时继续刷新重放，
+// 直到达到 retry_send_times 或 retry_deadline，最后按 on_retries_exhausted 处理
+func refreshAndReplay(ctx wrapper.HttpContext, cfg config.SimpleConfig, tm *token.TokenManager, retryCtx *RetryContext) {
 	retryCtx.RetryCount++
 	ctx.SetContext(ContextKey, retryCtx)
 
 	log.Infof("Attempting retry %d/%d with fresh token", retryCtx.RetryCount, retryCtx.MaxRetries)
 
-	// 1️⃣ 先发起 token 请求（异步）
-	tm.RequestTokenAsync(config, func(token string, err error) {
+	// 1️⃣ 先刷新 token（异步，其他 VM 已刷新时直接复用），等待时间不超过剩余的总时限
+	staleToken, _ := ctx.GetContext(token.UsedTokenKey).(string)
+	tm.RefreshToken(ctx, cfg, staleToken, retryCtx.Deadline, func(newToken string, err error) {
+		if errors.Is(err, token.ErrDeadlineExceeded) {
+			log.Warnf("Retry deadline exceeded while refreshing token, giving up")
+			sendRetryFailed(cfg.TokenConfig, "retry deadline exceeded", "Request failed")
+			return
+		}
+		if token.IsCircuitOpen(err) {
+			log.Warnf("Token service circuit breaker is open, skip retry")
+			tm.SendCircuitOpenResponse(cfg)
+			return
+		}
 		if err != nil {
 			log.Errorf("Failed to fetch token for retry: %v", err)
 			// ❌ 不能在这里调用 AbortWithPanic
 			// 改为：发送错误响应
-			proxywasm.SendHttpResponse(500, [][2]string{
-				{"content-type", "text/plain"},
-			}, []byte("Failed to fetch token"), -1)
+			sendRetryFailed(cfg.TokenConfig, token.ErrorReason(err), "Failed to fetch token")
 			return
 		}
 
-		log.Infof("✅ Token fetched successfully, length: %d", len(token))
+		log.Infof("✅ Token fetched successfully, length: %d", len(newToken))
 
-		// 2️⃣ 构建原始请求
-		var path, authority, method, scheme = "", "", "GET", "http"
-		for _, header := range retryCtx.OriginalHeaders {
-			switch header[0] {
-			case ":path":
-				path = header[1]
-			case ":authority":
-				authority = header[1]
-			case ":method":
-				method = header[1]
-			case "scheme":
-				scheme = header[1]
+		// 2️⃣ 退避等待后重放，避免立即再次请求压力较大的上游
+		delay := token.BackoffDelay(cfg.TokenConfig.RetryBackoff, retryCtx.RetryCount)
+		if delay <= 0 {
+			replay(ctx, cfg, tm, retryCtx, newToken)
+			return
+		}
+		if !retryCtx.Deadline.IsZero() && time.Now().Add(delay).After(retryCtx.Deadline) {
+			log.Warnf("Retry deadline would be exceeded after backoff, giving up")
+			sendRetryFailed(cfg.TokenConfig, "retry deadline exceeded", "Request failed")
+			return
+		}
+		log.Debugf("Waiting %v before replaying request", delay)
+		scheduler.After(delay, func() {
+			if !token.ActivateContext(ctx) {
+				return
 			}
+			replay(ctx, cfg, tm, retryCtx, newToken)
+		})
+	})
+}
+
+// replay 用 newToken 重放原始请求，并检查重放的响应
+func replay(ctx wrapper.HttpContext, cfg config.SimpleConfig, tm *token.TokenManager, retryCtx *RetryContext, newToken string) {
+	// 构建原始请求
+	var path, authority, method, scheme = "", "", "GET", "http"
+	for _, header := range retryCtx.OriginalHeaders {
+		switch header[0] {
+		case ":path":
+			path = header[1]
+		case ":authority":
+			authority = header[1]
+		case ":method":
+			method = header[1]
+		case "scheme":
+			scheme = header[1]
 		}
+	}
 
-		if scheme == "http" {
-			for _, header := range retryCtx.OriginalHeaders {
-				if header[0] == "x-forwarded-proto" && header[1] == "https" {
-					scheme = "https"
-					break
-				}
+	if scheme == "http" {
+		for _, header := range retryCtx.OriginalHeaders {
+			if header[0] == "x-forwarded-proto" && header[1] == "https" {
+				scheme = "https"
+				break
 			}
 		}
+	}
+
+	if path == "" || authority == "" {
+		log.Warnf("❌ Missing required headers - path: '%s', authority: '%s'", path, authority)
+		sendRetryFailed(cfg.TokenConfig, "missing :path or :authority in original request", "Invalid request")
+		return
+	}
+
+	// 构建 headers，按 token_injection 注入 token（覆盖原请求中的旧 token）
+	headers := [][2]string{}
+	for _, h := range retryCtx.OriginalHeaders {
+		switch h[0] {
+		case ":method", ":path", ":authority", ":scheme", "host", "Host":
+			continue
+		}
+		headers = append(headers, h)
+	}
+	headers, body := tm.InjectInto(cfg, newToken, headers, retryCtx.OriginalBody)
+	ctx.SetContext(token.UsedTokenKey, newToken)
 
-		if path == "" || authority == "" {
-			log.Warnf("❌ Missing required headers - path: '%s', authority: '%s'", path, authority)
-			proxywasm.SendHttpResponse(500, [][2]string{{"content-type", "text/plain"}}, []byte("Invalid request"), -1)
+	// 每次重放的超时不超过剩余的总时限
+	timeout := cfg.TokenConfig.RetryTimeout
+	if !retryCtx.Deadline.IsZero() {
+		remaining := time.Until(retryCtx.Deadline).Milliseconds()
+		if remaining <= 0 {
+			log.Warnf("Retry deadline exceeded, giving up")
+			sendRetryFailed(cfg.TokenConfig, "retry deadline exceeded", "Request failed")
 			return
 		}
+		if remaining < int64(timeout) {
+			timeout = uint32(remaining)
+		}
+	}
 
-		// 构建 headers（注入 token）
-		headers := [][2]string{}
-		for _, h := range retryCtx.OriginalHeaders {
-			switch h[0] {
-			case ":method", ":path", ":authority", ":scheme", "host", "Host":
-				continue
-			}
-			headers = append(headers, h)
+	// 发送重试请求
+	client := replayClient(cfg, retryCtx, authority)
+	if client == nil {
+		log.Errorf("No upstream cluster to replay the request")
+		sendRetryFailed(cfg.TokenConfig, "no upstream cluster for replay", "Request failed")
+		return
+	}
+	err := client.Call(method, path, headers, body, func(statusCode int, responseHeaders http.Header, responseBody []byte) {
+		if !token.ActivateContext(ctx) {
+			return
+		}
+		// 不检查响应体的类型或无法解码时只判断状态码和响应头
+		var checkedBody []byte
+		if shouldInspect(cfg.TokenConfig, responseHeaders) {
+			checkedBody, _ = token.DecodeForInspection(cfg.TokenConfig, responseHeaders, responseBody)
 		}
-		headers = append(headers, [2]string{"Authorization", "Bearer " + token})
-
-		// 3️⃣ 发送重试请求
-		client := config.GwService.Client
-		err = client.Call(method, path, headers, retryCtx.OriginalBody, func(statusCode int, responseHeaders http.Header, responseBody []byte) {
-			var respHeaders [][2]string
-			for k, v := range responseHeaders {
-				if len(v) > 0 {
-					respHeaders = append(respHeaders, [2]string{k, v[0]})
-				}
+		switch retryCtx.nextStep(tm.IsTokenInvalid(statusCode, responseHeaders, checkedBody, cfg)) {
+		case stepRetry:
+			log.Infof("Retried request still rejected the token")
+			refreshAndReplay(ctx, cfg, tm, retryCtx)
+			return
+		case stepExhausted:
+			log.Infof("Retries exhausted after %d attempts, giving up", retryCtx.RetryCount)
+			if sendRetriesExhausted(cfg.TokenConfig, retryCtx.RetryCount) {
+				return
 			}
-			proxywasm.SendHttpResponse(uint32(statusCode), respHeaders, responseBody, -1)
-			log.Infof("✅ Retry request completed with status %d", statusCode)
-		}, 5000)
-
-		if err != nil {
-			log.Errorf("Failed to send retry request: %v", err)
-			proxywasm.SendHttpResponse(500, [][2]string{{"content-type", "text/plain"}}, []byte("Request failed"), -1)
 		}
+
+		respHeaders := replayResponseHeaders(responseHeaders, responseBody, cfg.TokenConfig.RetryMarkerHeader, retryCtx.RetryCount)
+		proxywasm.SendHttpResponse(uint32(statusCode), respHeaders, responseBody, -1)
+		log.Infof("✅ Retry request completed with status %d", statusCode)
+	}, timeout)
+
+	if err != nil {
+		log.Errorf("Failed to send retry request: %v", err)
+		sendRetryFailed(cfg.TokenConfig, err.Error(), "Request failed")
+	}
+}
+
+// replayClient 重放请求使用的客户端：配置了 gateway_service 时经网关转发，
+// 否则直接发往当前路由的上游集群，两者都没有时返回 nil
+func replayClient(cfg config.SimpleConfig, retryCtx *RetryContext, authority string) wrapper.HttpClient {
+	if cfg.GwService.Client != nil {
+		return cfg.GwService.Client
+	}
+	if retryCtx.Cluster == "" {
+		return nil
+	}
+	return wrapper.NewClusterClient(wrapper.TargetCluster{
+		Host:    authority,
+		Cluster: retryCtx.Cluster,
 	})
+}
 
-	// 🛑 暂停请求处理，等待 token 获取和重试完成
-	return types.ActionPause
+// routeCluster 读取当前路由选中的上游集群名
+func routeCluster() string {
+	cluster, err := proxywasm.GetProperty([]string{"cluster_name"})
+	if err != nil {
+		log.Debugf("Failed to get cluster_name: %v", err)
+		return ""
+	}
+	return string(cluster)
+}
+
+// sendRetryFailed 重放失败时按 error_responses.retry_failed 返回错误响应，未配置时返回纯文本 fallbackBody
+func sendRetryFailed(tokenConfig config.TokenConfig, reason string, fallbackBody string) {
+	fallback := config.ErrorResponse{
+		StatusCode: 500,
+		Headers:    map[string]string{"content-type": "text/plain"},
+		Body:       fallbackBody,
+	}
+	if err := token.SendErrorResponse(tokenConfig, config.ErrorKindRetryFailed, "token.retry.failed", reason, fallback); err != nil {
+		log.Errorf("Failed to send error response: %v", err)
+	}
+}
+
+// sendRetriesExhausted 重放次数用尽、上游仍判定 token 无效时，on_retries_exhausted 为 error 则返回
+// error_responses.retries_exhausted（未配置时为内置的 401），否则返回 false，由调用方把上游响应原样返回
+func sendRetriesExhausted(tokenConfig config.TokenConfig, maxRetries int) bool {
+	if tokenConfig.OnRetriesExhausted != config.OnRetriesExhaustedError {
+		return false
+	}
+	reason := fmt.Sprintf("token still rejected after %d retries", maxRetries)
+	fallback := config.ErrorResponse{
+		StatusCode: 401,
+		Headers:    map[string]string{"content-type": "text/plain"},
+		Body:       "Token rejected after retries",
+	}
+	if err := token.SendErrorResponse(tokenConfig, config.ErrorKindRetriesExhausted, "token.retries.exhausted", reason, fallback); err != nil {
+		log.Errorf("Failed to send error response: %v", err)
+		return false
+	}
+	return true
+}
+
+// shouldInspect 只有 content-type 匹配 inspect_media_types 的响应才检查响应体
+func shouldInspect(tokenConfig config.TokenConfig, headers http.Header) bool {
+	return tokenConfig.InspectMatcher.Match(headers.Get("content-type"))
 }
 
 // InitializeRetryContext 初始化重试上下文
-func InitializeRetryContext(ctx wrapper.HttpContext, headers [][2]string, config config.SimpleConfig) *RetryContext {
+func InitializeRetryContext(ctx wrapper.HttpContext, headers [][2]string, cfg config.SimpleConfig) *RetryContext {
 	retryCtx := &RetryContext{
 		OriginalHeaders: headers,
-		MaxRetries:      config.TokenConfig.RetrySendTimes,
+		MaxRetries:      cfg.TokenConfig.RetrySendTimes,
 		RetryCount:      0,
 	}
+	if cfg.GwService.Client == nil {
+		retryCtx.Cluster = routeCluster()
+	}
 	ctx.SetContext(ContextKey, retryCtx)
 	return retryCtx
 }
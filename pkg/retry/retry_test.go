@@ -0,0 +1,54 @@
+package retry
+
+import (
+	"testing"
+	"time"
+)
+
+func TestNextStep(t *testing.T) {
+	tests := []struct {
+		name         string
+		retryCount   int
+		maxRetries   int
+		deadline     time.Time
+		tokenInvalid bool
+		want         replayStep
+	}{
+		{"token accepted", 1, 3, time.Time{}, false, stepForward},
+		{"token accepted on last retry", 3, 3, time.Time{}, false, stepForward},
+		{"first rejection", 0, 3, time.Time{}, true, stepRetry},
+		{"rejected again", 2, 3, time.Time{}, true, stepRetry},
+		{"rejected after last retry", 3, 3, time.Time{}, true, stepExhausted},
+		{"retries disabled", 0, 0, time.Time{}, true, stepExhausted},
+		{"rejected before deadline", 1, 3, time.Now().Add(time.Minute), true, stepRetry},
+		{"rejected after deadline", 1, 3, time.Now().Add(-time.Millisecond), true, stepExhausted},
+		{"accepted after deadline", 1, 3, time.Now().Add(-time.Millisecond), false, stepForward},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			retryCtx := &RetryContext{RetryCount: tt.retryCount, MaxRetries: tt.maxRetries, Deadline: tt.deadline}
+			if got := retryCtx.nextStep(tt.tokenInvalid); got != tt.want {
+				t.Errorf("nextStep(%v) = %v, want %v", tt.tokenInvalid, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestReplayUntilRetrySendTimes(t *testing.T) {
+	// 上游始终判定 token 无效时，重放 retry_send_times 次后停止
+	for maxRetries := 0; maxRetries <= 3; maxRetries++ {
+		retryCtx := &RetryContext{MaxRetries: maxRetries}
+		replays := 0
+		for retryCtx.nextStep(true) == stepRetry {
+			// refreshAndReplay 每次重放前递增 RetryCount
+			retryCtx.RetryCount++
+			replays++
+			if replays > maxRetries {
+				t.Fatalf("retry_send_times %d: replayed more than %d times", maxRetries, maxRetries)
+			}
+		}
+		if replays != maxRetries {
+			t.Errorf("retry_send_times %d: replayed %d times", maxRetries, replays)
+		}
+	}
+}
@@ -0,0 +1,46 @@
+package scheduler
+
+import (
+	"time"
+)
+
+// TickPeriod 检查到期任务的周期（毫秒），也是延迟执行的最小精度
+const TickPeriod = 100
+
+type task struct {
+	at time.Time
+	fn func()
+}
+
+// tasks 等待执行的延迟任务，Wasm VM 是单线程的，无需加锁
+var tasks []task
+
+// After 在 delay 之后的第一个 tick 执行 fn
+// fn 在插件根上下文中执行，操作某个请求前需要先切换到该请求的上下文
+func After(delay time.Duration, fn func()) {
+	tasks = append(tasks, task{at: time.Now().Add(delay), fn: fn})
+}
+
+// RunDue 执行所有已到期的任务，由插件 tick 周期调用
+func RunDue() {
+	if len(tasks) == 0 {
+		return
+	}
+
+	now := time.Now()
+	var due []task
+	remaining := tasks[:0]
+	for _, t := range tasks {
+		if now.Before(t.at) {
+			remaining = append(remaining, t)
+		} else {
+			due = append(due, t)
+		}
+	}
+	tasks = remaining
+
+	// 任务执行时可能再次调用 After，先更新 tasks 再执行
+	for _, t := range due {
+		t.fn()
+	}
+}
@@ -0,0 +1,58 @@
+package token
+
+import (
+	"github.com/higress-group/proxy-wasm-go-sdk/proxywasm/types"
+	"github.com/higress-group/wasm-go/pkg/log"
+	"github.com/higress-group/wasm-go/pkg/wrapper"
+)
+
+// inspectLimitKey 请求上下文中记录最多缓存多少字节响应体的键
+const inspectLimitKey = "inspect-body-limit"
+
+// LimitInspectedBody 在响应头阶段记录本次响应最多缓存 limit 字节的响应体用于检查
+func LimitInspectedBody(ctx wrapper.HttpContext, limit uint32) {
+	ctx.SetContext(inspectLimitKey, limit)
+}
+
+// LimitResponseBody 包装 VM 上下文：缓存的响应体超过 LimitInspectedBody 记录的上限时放弃检查，
+// 已缓存的数据直接转发给下游。wrapper 在响应体结束后才回调插件，
+// 没有 content-length 的响应（如 chunked 编码）只能在缓存过程中按已缓存的大小限制
+func LimitResponseBody(vm types.VMContext) types.VMContext {
+	return &limitingVMContext{VMContext: vm}
+}
+
+type limitingVMContext struct {
+	types.VMContext
+}
+
+func (c *limitingVMContext) NewPluginContext(contextID uint32) types.PluginContext {
+	return &limitingPluginContext{PluginContext: c.VMContext.NewPluginContext(contextID)}
+}
+
+type limitingPluginContext struct {
+	types.PluginContext
+}
+
+func (c *limitingPluginContext) NewHttpContext(contextID uint32) types.HttpContext {
+	httpCtx := c.PluginContext.NewHttpContext(contextID)
+	ctx, ok := httpCtx.(wrapper.HttpContext)
+	if !ok {
+		return httpCtx
+	}
+	return &limitingHttpContext{HttpContext: httpCtx, ctx: ctx}
+}
+
+type limitingHttpContext struct {
+	types.HttpContext
+	ctx wrapper.HttpContext
+}
+
+// OnHttpResponseBody bodySize 为目前已缓存的响应体大小
+func (c *limitingHttpContext) OnHttpResponseBody(bodySize int, endOfStream bool) types.Action {
+	if limit, ok := c.ctx.GetContext(inspectLimitKey).(uint32); ok && uint64(bodySize) > uint64(limit) {
+		log.Debugf("response body too large (over %d bytes), skip inspecting response body", limit)
+		c.ctx.DontReadResponseBody()
+		return types.ActionContinue
+	}
+	return c.HttpContext.OnHttpResponseBody(bodySize, endOfStream)
+}
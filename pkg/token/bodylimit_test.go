@@ -0,0 +1,71 @@
+package token
+
+import (
+	"testing"
+
+	"github.com/higress-group/proxy-wasm-go-sdk/proxywasm/types"
+)
+
+// bufferingHttpContext 模拟 wrapper 的缓存模式：响应体结束前一直暂停
+type bufferingHttpContext struct {
+	fakeHttpContext
+	skipped bool
+	calls   int
+}
+
+func (c *bufferingHttpContext) DontReadResponseBody() { c.skipped = true }
+
+func (c *bufferingHttpContext) OnHttpResponseBody(bodySize int, endOfStream bool) types.Action {
+	c.calls++
+	if c.skipped || endOfStream {
+		return types.ActionContinue
+	}
+	return types.ActionPause
+}
+
+func TestLimitingHttpContext(t *testing.T) {
+	tests := []struct {
+		name        string
+		limit       interface{} // nil 表示响应头阶段没有记录上限
+		chunks      []int       // 每次回调时已缓存的大小，最后一次为响应体结束
+		wantActions []types.Action
+		wantSkipped bool
+	}{
+		{
+			name:        "within limit",
+			limit:       uint32(100),
+			chunks:      []int{40, 80, 100},
+			wantActions: []types.Action{types.ActionPause, types.ActionPause, types.ActionContinue},
+		},
+		{
+			name:        "chunked body over limit",
+			limit:       uint32(100),
+			chunks:      []int{60, 120, 180},
+			wantActions: []types.Action{types.ActionPause, types.ActionContinue, types.ActionContinue},
+			wantSkipped: true,
+		},
+		{
+			name:        "no limit recorded",
+			chunks:      []int{1 << 20, 2 << 20},
+			wantActions: []types.Action{types.ActionPause, types.ActionContinue},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			inner := &bufferingHttpContext{fakeHttpContext: fakeHttpContext{values: make(map[string]interface{})}}
+			if tt.limit != nil {
+				inner.SetContext(inspectLimitKey, tt.limit)
+			}
+			ctx := &limitingHttpContext{HttpContext: inner, ctx: inner}
+			for i, size := range tt.chunks {
+				got := ctx.OnHttpResponseBody(size, i == len(tt.chunks)-1)
+				if got != tt.wantActions[i] {
+					t.Errorf("chunk %d (%d bytes): action = %v, want %v", i, size, got, tt.wantActions[i])
+				}
+			}
+			if inner.skipped != tt.wantSkipped {
+				t.Errorf("skipped = %v, want %v", inner.skipped, tt.wantSkipped)
+			}
+		})
+	}
+}
@@ -0,0 +1,211 @@
+package token
+
+import (
+	"bst-auth/pkg/config"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/higress-group/proxy-wasm-go-sdk/proxywasm"
+	"github.com/higress-group/proxy-wasm-go-sdk/proxywasm/types"
+	"github.com/higress-group/wasm-go/pkg/log"
+)
+
+const sharedBreakerKeyPrefix = "ext-auth-wasm:token-breaker:"
+
+// 熔断器状态
+const (
+	breakerClosed   = "closed"    // 正常调用 token 服务，统计失败比例
+	breakerOpen     = "open"      // 熔断中，直接返回 circuit_breaker.open_* 配置的响应
+	breakerHalfOpen = "half_open" // 冷却结束，放行一次探测请求，成功则恢复，失败则继续熔断
+)
+
+// ErrCircuitOpen token 服务熔断中，不再发起 token 请求
+var ErrCircuitOpen = errors.New("token service circuit breaker is open")
+
+// IsCircuitOpen err 是否表示 token 服务熔断中
+func IsCircuitOpen(err error) bool {
+	return errors.Is(err, ErrCircuitOpen)
+}
+
+// breakerState 保存在共享数据中的熔断器状态，所有 worker VM 共用
+type breakerState struct {
+	State       string `json:"state"`
+	WindowStart int64  `json:"window_start"` // 当前统计窗口开始时间，毫秒时间戳
+	Requests    int    `json:"requests"`     // 当前统计窗口内的调用次数
+	Failures    int    `json:"failures"`     // 当前统计窗口内的失败次数
+	OpenedAt    int64  `json:"opened_at"`    // 最近一次熔断的时间，毫秒时间戳
+}
+
+// loadBreaker 读取熔断器状态，不存在时视为 closed
+func loadBreaker(key string) (breakerState, uint32, error) {
+	state := breakerState{State: breakerClosed}
+	data, cas, err := proxywasm.GetSharedData(key)
+	if err != nil {
+		if errors.Is(err, types.ErrorStatusNotFound) {
+			return state, cas, nil
+		}
+		return state, cas, err
+	}
+	if len(data) == 0 {
+		return state, cas, nil
+	}
+	if err := json.Unmarshal(data, &state); err != nil {
+		// 数据损坏时视为未熔断
+		return breakerState{State: breakerClosed}, cas, nil
+	}
+	return state, cas, nil
+}
+
+// updateBreaker 读取熔断器状态并用 update 修改后写回，CAS 冲突时重试
+// update 返回 false 表示无需写回
+func updateBreaker(key string, update func(*breakerState) bool) error {
+	for i := 0; i < maxCasRetries; i++ {
+		state, cas, err := loadSeeded(key, loadBreaker)
+		if err != nil {
+			return err
+		}
+		if cas == 0 {
+			// 以 cas 0 写入是无条件覆盖，会丢失其他 VM 同时记录的结果
+			return types.ErrorStatusNotFound
+		}
+		if !update(&state) {
+			return nil
+		}
+		data, _ := json.Marshal(state)
+		err = proxywasm.SetSharedData(key, data, cas)
+		if err == nil {
+			return nil
+		}
+		if !errors.Is(err, types.ErrorStatusCasMismatch) {
+			return err
+		}
+	}
+	return types.ErrorStatusCasMismatch
+}
+
+// breakerRejects 熔断中且冷却未结束时返回 true，此时不应发起 token 请求
+func (tm *TokenManager) breakerRejects(breaker config.CircuitBreaker) bool {
+	if !breaker.Enabled {
+		return false
+	}
+	state, _, err := loadBreaker(tm.sharedBreakerKey)
+	if err != nil {
+		log.Warnf("读取熔断器状态失败: %v", err)
+		return false
+	}
+	return state.rejects(breaker, time.Now().UnixMilli())
+}
+
+// rejects 熔断中且在 now（毫秒时间戳）时冷却未结束
+func (state breakerState) rejects(breaker config.CircuitBreaker, now int64) bool {
+	cooldown := breaker.Cooldown * int64(time.Second/time.Millisecond)
+	return state.State == breakerOpen && now < state.OpenedAt+cooldown
+}
+
+// beginProbe 在发起 token 请求前调用，冷却结束的熔断器进入 half_open
+// 刷新租约保证同一时间只有一个探测请求
+func (tm *TokenManager) beginProbe(breaker config.CircuitBreaker) {
+	if !breaker.Enabled {
+		return
+	}
+	err := updateBreaker(tm.sharedBreakerKey, func(state *breakerState) bool {
+		if state.State != breakerOpen {
+			return false
+		}
+		state.State = breakerHalfOpen
+		return true
+	})
+	if err != nil {
+		log.Warnf("更新熔断器状态失败: %v", err)
+		return
+	}
+	log.Debugf("token 服务熔断冷却结束，发起探测请求")
+}
+
+// recordFetchResult 记录一次 token 服务调用结果，更新熔断器状态
+func (tm *TokenManager) recordFetchResult(breaker config.CircuitBreaker, fetchErr error) {
+	if !breaker.Enabled {
+		return
+	}
+	failed := isBreakerFailure(fetchErr)
+	now := time.Now().UnixMilli()
+
+	var transition breakerTransition
+	err := updateBreaker(tm.sharedBreakerKey, func(state *breakerState) bool {
+		var changed bool
+		changed, transition = state.record(breaker, failed, now)
+		return changed
+	})
+	if err != nil {
+		log.Warnf("更新熔断器状态失败: %v", err)
+		return
+	}
+	switch transition {
+	case breakerOpened:
+		log.Warnf("token 服务不可用，熔断 %d 秒", breaker.Cooldown)
+	case breakerClosedAgain:
+		log.Infof("token 服务已恢复，关闭熔断")
+	}
+}
+
+// breakerTransition 一次调用结果引起的熔断器状态切换
+type breakerTransition int
+
+const (
+	breakerUnchanged   breakerTransition = iota
+	breakerOpened                        // 进入熔断
+	breakerClosedAgain                   // 探测成功，关闭熔断
+)
+
+// record 把一次调用结果计入状态，now 为毫秒时间戳
+// 返回状态是否需要写回，以及引起的状态切换
+func (state *breakerState) record(breaker config.CircuitBreaker, failed bool, now int64) (bool, breakerTransition) {
+	switch state.State {
+	case breakerHalfOpen, breakerOpen:
+		if failed {
+			if state.State == breakerOpen {
+				// 熔断前发出的请求，结果不影响冷却时间
+				return false, breakerUnchanged
+			}
+			state.State = breakerOpen
+			state.OpenedAt = now
+			return true, breakerOpened
+		}
+		*state = breakerState{State: breakerClosed, WindowStart: now}
+		return true, breakerClosedAgain
+	default:
+		window := breaker.Window * int64(time.Second/time.Millisecond)
+		if now-state.WindowStart >= window {
+			state.WindowStart, state.Requests, state.Failures = now, 0, 0
+		}
+		state.Requests++
+		if failed {
+			state.Failures++
+		}
+		if state.Requests >= breaker.MinimumRequests &&
+			float64(state.Failures) >= breaker.FailureRateThreshold*float64(state.Requests) {
+			state.State = breakerOpen
+			state.OpenedAt = now
+			return true, breakerOpened
+		}
+		return true, breakerUnchanged
+	}
+}
+
+// isBreakerFailure 是否计入熔断失败：没有收到响应，或 token 服务返回 429/5xx
+// 其他错误（如凭证错误、提取失败）说明服务本身可用，不计入
+func isBreakerFailure(err error) bool {
+	if err == nil {
+		return false
+	}
+	var fetchErr *FetchError
+	if errors.As(err, &fetchErr) {
+		return true
+	}
+	var serviceErr *TokenServiceError
+	if errors.As(err, &serviceErr) {
+		return serviceErr.StatusCode == 429 || serviceErr.StatusCode >= 500
+	}
+	return false
+}
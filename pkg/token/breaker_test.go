@@ -0,0 +1,113 @@
+package token
+
+import (
+	"bst-auth/pkg/config"
+	"errors"
+	"fmt"
+	"testing"
+)
+
+func TestIsCircuitOpen(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"nil", nil, false},
+		{"circuit open", ErrCircuitOpen, true},
+		{"wrapped", fmt.Errorf("refresh: %w", ErrCircuitOpen), true},
+		{"other error", errors.New("boom"), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := IsCircuitOpen(tt.err); got != tt.want {
+				t.Errorf("IsCircuitOpen(%v) = %v, want %v", tt.err, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestIsBreakerFailure(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"success", nil, false},
+		{"timeout", &FetchError{Kind: config.FetchErrorTimeout}, true},
+		{"dispatch failed", dispatchFailed(errors.New("no cluster")), true},
+		{"too many requests", &TokenServiceError{StatusCode: 429}, true},
+		{"server error", &TokenServiceError{StatusCode: 503}, true},
+		{"bad credentials", &TokenServiceError{StatusCode: 401}, false},
+		{"wrapped server error", fmt.Errorf("fetch: %w", &TokenServiceError{StatusCode: 500}), true},
+		{"extraction failed", errors.New("token not found"), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := isBreakerFailure(tt.err); got != tt.want {
+				t.Errorf("isBreakerFailure(%v) = %v, want %v", tt.err, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestBreakerStateRecord(t *testing.T) {
+	breaker := config.CircuitBreaker{
+		Enabled:              true,
+		FailureRateThreshold: 0.5,
+		MinimumRequests:      4,
+		Window:               10,
+		Cooldown:             30,
+	}
+	const start = int64(1_000_000)
+
+	state := breakerState{State: breakerClosed, WindowStart: start}
+	// 调用次数不足 minimum_requests 时不熔断
+	for i, failed := range []bool{true, true, true} {
+		if _, transition := state.record(breaker, failed, start+int64(i)); transition != breakerUnchanged {
+			t.Fatalf("call %d opened the breaker before minimum_requests", i+1)
+		}
+	}
+	changed, transition := state.record(breaker, false, start+3)
+	if !changed || transition != breakerOpened || state.State != breakerOpen || state.OpenedAt != start+3 {
+		t.Fatalf("3/4 failures: changed %v, transition %v, state %+v, want opened", changed, transition, state)
+	}
+
+	// 熔断前发出的请求失败不影响冷却时间
+	if changed, _ := state.record(breaker, true, start+100); changed || state.OpenedAt != start+3 {
+		t.Errorf("failure while open changed the state: %+v", state)
+	}
+	if !state.rejects(breaker, start+3+29_999) || state.rejects(breaker, start+3+30_000) {
+		t.Errorf("rejects() does not follow the 30s cooldown")
+	}
+
+	// 探测失败重新熔断，探测成功关闭熔断
+	state.State = breakerHalfOpen
+	if _, transition := state.record(breaker, true, start+40_000); transition != breakerOpened || state.OpenedAt != start+40_000 {
+		t.Errorf("failed probe: transition %v, state %+v, want reopened", transition, state)
+	}
+	state.State = breakerHalfOpen
+	_, transition = state.record(breaker, false, start+80_000)
+	want := breakerState{State: breakerClosed, WindowStart: start + 80_000}
+	if transition != breakerClosedAgain || state != want {
+		t.Errorf("successful probe: transition %v, state %+v, want %+v", transition, state, want)
+	}
+}
+
+func TestBreakerStateRecordWindow(t *testing.T) {
+	breaker := config.CircuitBreaker{FailureRateThreshold: 0.5, MinimumRequests: 2, Window: 10}
+	const start = int64(1_000_000)
+
+	state := breakerState{State: breakerClosed, WindowStart: start}
+	state.record(breaker, true, start)
+	// 统计窗口结束后重新计数，上个窗口的失败不再计入
+	if _, transition := state.record(breaker, false, start+10_000); transition != breakerUnchanged {
+		t.Fatalf("failure from the previous window opened the breaker")
+	}
+	if state.WindowStart != start+10_000 || state.Requests != 1 || state.Failures != 0 {
+		t.Errorf("state after window reset = %+v", state)
+	}
+	if _, transition := state.record(breaker, true, start+10_001); transition != breakerOpened {
+		t.Errorf("1/2 failures in the window did not open the breaker: %+v", state)
+	}
+}
@@ -0,0 +1,123 @@
+package token
+
+import (
+	"bst-auth/pkg/config"
+	"bst-auth/pkg/contentcoding"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/higress-group/proxy-wasm-go-sdk/proxywasm"
+	"github.com/higress-group/wasm-go/pkg/log"
+	"github.com/tidwall/gjson"
+)
+
+// 未配置 token_error_message_path 时依次尝试的错误信息字段
+var defaultErrorMessagePaths = []string{"message", "msg", "error_description", "error"}
+
+// TokenServiceError token 服务拒绝了请求（非 200 或不满足 token_success_condition）
+// Message 为上游返回的错误信息，会带给客户端
+type TokenServiceError struct {
+	StatusCode int
+	Message    string
+}
+
+func (e *TokenServiceError) Error() string {
+	if e.Message == "" {
+		return fmt.Sprintf("http %d", e.StatusCode)
+	}
+	return fmt.Sprintf("http %d: %s", e.StatusCode, e.Message)
+}
+
+// checkTokenResponse 判断 token 服务的响应是否可用
+// 非 200 或不满足 token_success_condition 时返回 *TokenServiceError
+func checkTokenResponse(statusCode int, headers http.Header, responseBody []byte, tokenConfig config.TokenConfig) error {
+	if statusCode != 200 {
+		return &TokenServiceError{
+			StatusCode: statusCode,
+			Message:    errorMessage(responseBody, tokenConfig.TokenErrorMessagePath),
+		}
+	}
+	if tokenConfig.TokenSuccessProgram == nil {
+		return nil
+	}
+
+	program := tokenConfig.TokenSuccessProgram
+	ok, err := program.Eval(program.NewEnv(statusCode, headers, responseBody))
+	if err != nil {
+		return fmt.Errorf("token_success_condition: %v", err)
+	}
+	if !ok {
+		return &TokenServiceError{
+			StatusCode: statusCode,
+			Message:    errorMessage(responseBody, tokenConfig.TokenErrorMessagePath),
+		}
+	}
+	return nil
+}
+
+// errorMessage 从 token 服务响应中读取错误信息
+func errorMessage(responseBody []byte, messagePath string) string {
+	if !gjson.ValidBytes(responseBody) {
+		return ""
+	}
+	if messagePath != "" {
+		return gjson.GetBytes(responseBody, messagePath).String()
+	}
+	for _, path := range defaultErrorMessagePaths {
+		if message := gjson.GetBytes(responseBody, path); message.Type == gjson.String && message.String() != "" {
+			return message.String()
+		}
+	}
+	return ""
+}
+
+// InvalidConditionNeedsBody invalid_token_condition 是否需要响应体才能判断
+func InvalidConditionNeedsBody(tokenConfig config.TokenConfig) bool {
+	return tokenConfig.InvalidTokenProgram.NeedsBody()
+}
+
+// CurrentResponse 读取当前请求的响应状态码和响应头
+func CurrentResponse() (int, http.Header) {
+	headers, err := proxywasm.GetHttpResponseHeaders()
+	if err != nil {
+		log.Warnf("读取响应头失败: %v", err)
+	}
+	h := make(http.Header, len(headers))
+	for _, header := range headers {
+		h[strings.ToLower(header[0])] = append(h[strings.ToLower(header[0])], header[1])
+	}
+	status, _ := strconv.Atoi(firstHeader(h, ":status"))
+	return status, h
+}
+
+// firstHeader 读取响应头的第一个值，键不要求是规范格式
+func firstHeader(headers http.Header, name string) string {
+	for k, v := range headers {
+		if strings.EqualFold(k, name) && len(v) > 0 {
+			return v[0]
+		}
+	}
+	return ""
+}
+
+// DecodeForInspection 按 content-encoding 解码响应体，用于检查 invalid_token_condition
+// 返回的是解码后的副本，转发给下游的仍是原始字节；无法解码或超过 max_inspect_body_size 时返回 false，此时不检查响应体
+func DecodeForInspection(tokenConfig config.TokenConfig, headers http.Header, body []byte) ([]byte, bool) {
+	maxSize := int(tokenConfig.MaxInspectBodySize)
+	if len(body) > maxSize {
+		log.Debugf("响应体超过 max_inspect_body_size（%d 字节），跳过检查", maxSize)
+		return nil, false
+	}
+	contentEncoding := firstHeader(headers, "content-encoding")
+	if contentEncoding == "" {
+		return body, true
+	}
+	decoded, err := contentcoding.Decode(contentEncoding, body, maxSize)
+	if err != nil {
+		log.Warnf("解码响应体失败，跳过检查: %v", err)
+		return nil, false
+	}
+	return decoded, true
+}
@@ -0,0 +1,117 @@
+package token
+
+import (
+	"bst-auth/pkg/condition"
+	"bst-auth/pkg/config"
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// successConfig 带 token_success_condition 的配置，condition 为空表示未配置
+func successConfig(t *testing.T, source, messagePath string) config.TokenConfig {
+	tokenConfig := config.TokenConfig{TokenSuccessCondition: source, TokenErrorMessagePath: messagePath}
+	if source != "" {
+		program, err := condition.Compile(source)
+		if err != nil {
+			t.Fatalf("compile %q: %v", source, err)
+		}
+		tokenConfig.TokenSuccessProgram = program
+	}
+	return tokenConfig
+}
+
+// checkResponse 用 body 作为 token 服务的响应调用 checkTokenResponse
+func checkResponse(statusCode int, body string, tokenConfig config.TokenConfig) error {
+	headers := http.Header{"Content-Type": {"application/json"}}
+	return checkTokenResponse(statusCode, headers, []byte(body), tokenConfig)
+}
+
+func TestCheckTokenResponse(t *testing.T) {
+	tests := []struct {
+		name        string
+		statusCode  int
+		body        string
+		condition   string
+		messagePath string
+		wantErr     string
+		wantService bool // 是否应返回 *TokenServiceError
+	}{
+		{name: "200 without condition", statusCode: 200, body: `{"token":"abc"}`},
+		{name: "200 with non-json body", statusCode: 200, body: `token=abc`},
+		{
+			name: "non-200 with oauth2 error", statusCode: 401,
+			body:    `{"error":"invalid_client","error_description":"bad secret"}`,
+			wantErr: "http 401: bad secret", wantService: true,
+		},
+		{name: "non-200 without message", statusCode: 503, body: `upstream down`, wantErr: "http 503", wantService: true},
+		{name: "condition met", statusCode: 200, body: `{"code":0,"data":{"token":"abc"}}`, condition: `code == 0`},
+		{
+			name: "condition not met", statusCode: 200, body: `{"code":1001,"msg":"account locked"}`, condition: `code == 0`,
+			wantErr: "http 200: account locked", wantService: true,
+		},
+		{
+			name: "condition not met with message path", statusCode: 200,
+			body:      `{"code":1001,"msg":"generic","detail":{"reason":"expired credential"}}`,
+			condition: `code == 0`, messagePath: "detail.reason",
+			wantErr: "http 200: expired credential", wantService: true,
+		},
+		{
+			name: "condition field missing", statusCode: 200, body: `{"token":"abc"}`, condition: `code != 1`,
+			wantErr: "http 200", wantService: true,
+		},
+		{name: "condition on non-json body", statusCode: 200, body: `token=abc`, condition: `code == 0`, wantErr: "http 200", wantService: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := checkResponse(tt.statusCode, tt.body, successConfig(t, tt.condition, tt.messagePath))
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				return
+			}
+			if err == nil {
+				t.Fatalf("error = nil, want %q", tt.wantErr)
+			}
+			var serviceErr *TokenServiceError
+			if errors.As(err, &serviceErr) != tt.wantService {
+				t.Errorf("TokenServiceError = %v, want %v (err %v)", !tt.wantService, tt.wantService, err)
+			}
+			if tt.wantService && err.Error() != tt.wantErr {
+				t.Errorf("error = %q, want %q", err, tt.wantErr)
+			}
+			if !tt.wantService && !strings.HasPrefix(err.Error(), tt.wantErr) {
+				t.Errorf("error = %q, want prefix %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestErrorMessage(t *testing.T) {
+	tests := []struct {
+		name string
+		body string
+		path string
+		want string
+	}{
+		{"message", `{"message":"m","msg":"x"}`, "", "m"},
+		{"msg", `{"msg":"locked"}`, "", "locked"},
+		{"error_description before error", `{"error":"invalid_grant","error_description":"expired"}`, "", "expired"},
+		{"error only", `{"error":"invalid_grant"}`, "", "invalid_grant"},
+		{"skips empty and non-string fields", `{"message":"","msg":{"text":"x"},"error":"e"}`, "", "e"},
+		{"configured path", `{"detail":{"reason":"r"},"message":"m"}`, "detail.reason", "r"},
+		{"configured path missing", `{"message":"m"}`, "detail.reason", ""},
+		{"no known field", `{"code":1}`, "", ""},
+		{"not json", `<html>error</html>`, "", ""},
+		{"empty body", ``, "", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := errorMessage([]byte(tt.body), tt.path); got != tt.want {
+				t.Errorf("errorMessage() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
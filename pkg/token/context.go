@@ -0,0 +1,56 @@
+package token
+
+import (
+	"github.com/higress-group/proxy-wasm-go-sdk/proxywasm"
+	"github.com/higress-group/proxy-wasm-go-sdk/proxywasm/types"
+	"github.com/higress-group/wasm-go/pkg/log"
+	"github.com/higress-group/wasm-go/pkg/wrapper"
+)
+
+// contextIDKey 请求上下文中记录宿主 HTTP 上下文 ID 的键
+const contextIDKey = "http-context-id"
+
+// setEffectiveContext 切换宿主当前上下文，测试中替换为不依赖宿主的实现
+var setEffectiveContext = proxywasm.SetEffectiveContext
+
+// TrackContextIDs 包装 wrapper 创建的 VM 上下文：创建 HTTP 上下文时把宿主分配的上下文 ID
+// 记录到请求上下文中，供 ActivateContext 切换
+func TrackContextIDs(vm types.VMContext) types.VMContext {
+	return &trackingVMContext{VMContext: vm}
+}
+
+type trackingVMContext struct {
+	types.VMContext
+}
+
+func (c *trackingVMContext) NewPluginContext(contextID uint32) types.PluginContext {
+	return &trackingPluginContext{PluginContext: c.VMContext.NewPluginContext(contextID)}
+}
+
+type trackingPluginContext struct {
+	types.PluginContext
+}
+
+func (c *trackingPluginContext) NewHttpContext(contextID uint32) types.HttpContext {
+	httpCtx := c.PluginContext.NewHttpContext(contextID)
+	if ctx, ok := httpCtx.(wrapper.HttpContext); ok {
+		ctx.SetContext(contextIDKey, contextID)
+	}
+	return httpCtx
+}
+
+// ActivateContext 把宿主的当前上下文切换到 ctx，失败时返回 false
+// 在 tick 或其他请求触发的回调里操作暂停的请求前必须先切换；
+// 切换失败（如请求已被销毁）时当前上下文仍是别的请求，调用方必须放弃后续操作
+func ActivateContext(ctx wrapper.HttpContext) bool {
+	contextID, ok := ctx.GetContext(contextIDKey).(uint32)
+	if !ok {
+		log.Warnf("请求上下文中没有 HTTP 上下文 ID，无法切换上下文")
+		return false
+	}
+	if err := setEffectiveContext(contextID); err != nil {
+		log.Warnf("切换到 HTTP 上下文 %d 失败: %v", contextID, err)
+		return false
+	}
+	return true
+}
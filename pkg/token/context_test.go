@@ -0,0 +1,91 @@
+package token
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/higress-group/proxy-wasm-go-sdk/proxywasm/types"
+	"github.com/higress-group/wasm-go/pkg/wrapper"
+)
+
+// fakeHttpContext 只实现请求上下文的存取
+type fakeHttpContext struct {
+	wrapper.HttpContext
+	types.DefaultHttpContext
+	values map[string]interface{}
+}
+
+func (c *fakeHttpContext) SetContext(key string, value interface{}) { c.values[key] = value }
+
+func (c *fakeHttpContext) GetContext(key string) interface{} { return c.values[key] }
+
+type fakePluginContext struct {
+	types.DefaultPluginContext
+	created []*fakeHttpContext
+}
+
+func (c *fakePluginContext) NewHttpContext(contextID uint32) types.HttpContext {
+	ctx := &fakeHttpContext{values: make(map[string]interface{})}
+	c.created = append(c.created, ctx)
+	return ctx
+}
+
+type fakeVMContext struct {
+	types.DefaultVMContext
+	plugin *fakePluginContext
+}
+
+func (c *fakeVMContext) NewPluginContext(contextID uint32) types.PluginContext { return c.plugin }
+
+func TestTrackContextIDsRecordsHttpContextID(t *testing.T) {
+	plugin := &fakePluginContext{}
+	vm := TrackContextIDs(&fakeVMContext{plugin: plugin})
+
+	pluginCtx := vm.NewPluginContext(1)
+	pluginCtx.NewHttpContext(2)
+	pluginCtx.NewHttpContext(3)
+
+	if len(plugin.created) != 2 {
+		t.Fatalf("created %d http contexts, want 2", len(plugin.created))
+	}
+	for i, want := range []uint32{2, 3} {
+		got, ok := plugin.created[i].GetContext(contextIDKey).(uint32)
+		if !ok || got != want {
+			t.Errorf("context %d: recorded id = %v, want %d", i, plugin.created[i].GetContext(contextIDKey), want)
+		}
+	}
+}
+
+func TestResumeDropsWaiterWhenActivationFails(t *testing.T) {
+	defer func(orig func(uint32) error) { setEffectiveContext = orig }(setEffectiveContext)
+	setEffectiveContext = func(contextID uint32) error {
+		if contextID == 2 {
+			return errors.New("context not found")
+		}
+		return nil
+	}
+
+	tests := []struct {
+		name   string
+		values map[string]interface{}
+		want   bool
+	}{
+		{"activated", map[string]interface{}{contextIDKey: uint32(1)}, true},
+		{"missing id", map[string]interface{}{}, false},
+		{"destroyed context", map[string]interface{}{contextIDKey: uint32(2)}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := &fakeHttpContext{values: tt.values}
+			if got := ActivateContext(ctx); got != tt.want {
+				t.Errorf("ActivateContext() = %v, want %v", got, tt.want)
+			}
+			called := false
+			w := &tokenWaiter{ctx: ctx, callback: func(string, error) { called = true }}
+			w.resume("token", nil)
+			if called != tt.want {
+				t.Errorf("callback called = %v, want %v", called, tt.want)
+			}
+		})
+	}
+}
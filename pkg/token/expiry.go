@@ -0,0 +1,66 @@
+package token
+
+import (
+	"bst-auth/pkg/config"
+	"encoding/base64"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/tidwall/gjson"
+)
+
+// RefreshTickPeriod 检查 Token 是否需要主动刷新的周期（毫秒）
+const RefreshTickPeriod = 1000
+
+// resolveExpiry 计算 Token 的过期时间，无法确定时返回零值（表示不主动过期）
+// 优先使用响应中的有效期（秒），其次按配置解析 JWT 的 exp 声明
+func resolveExpiry(expiresIn int64, token string, extraction config.TokenExtraction) time.Time {
+	if expiresIn > 0 {
+		return time.Now().Add(time.Duration(expiresIn) * time.Second)
+	}
+	if extraction.ExpiryFromJwt {
+		exp, err := jwtExpiry(token)
+		if err == nil {
+			return exp
+		}
+	}
+	return time.Time{}
+}
+
+// refreshSkew 提前刷新的时间，不超过 Token 有效期的一半，
+// 避免有效期不大于 refresh_skew 时每次检查都刷新
+func refreshSkew(skew time.Duration, issuedAt, expiresAt time.Time) time.Duration {
+	if issuedAt.IsZero() {
+		return skew
+	}
+	if half := expiresAt.Sub(issuedAt) / 2; skew > half {
+		return half
+	}
+	return skew
+}
+
+// extractExpiresIn 按 expires_in_path 从响应体中读取有效期（秒）
+func extractExpiresIn(responseBody []byte, extraction config.TokenExtraction) int64 {
+	if extraction.ExpiresInPath == "" {
+		return 0
+	}
+	return gjson.GetBytes(responseBody, extraction.ExpiresInPath).Int()
+}
+
+// jwtExpiry 解码 JWT payload 中的 exp 声明（不校验签名）
+func jwtExpiry(token string) (time.Time, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return time.Time{}, fmt.Errorf("token is not a JWT")
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(parts[1], "="))
+	if err != nil {
+		return time.Time{}, fmt.Errorf("decode JWT payload failed: %v", err)
+	}
+	exp := gjson.GetBytes(payload, "exp")
+	if !exp.Exists() || exp.Int() <= 0 {
+		return time.Time{}, fmt.Errorf("JWT has no exp claim")
+	}
+	return time.Unix(exp.Int(), 0), nil
+}
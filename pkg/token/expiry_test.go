@@ -0,0 +1,96 @@
+package token
+
+import (
+	"bst-auth/pkg/config"
+	"encoding/base64"
+	"testing"
+	"time"
+)
+
+// testJWT 构造 payload 为 claims 的未签名 JWT
+func testJWT(claims string) string {
+	return "eyJhbGciOiJub25lIn0." + base64.RawURLEncoding.EncodeToString([]byte(claims)) + ".sig"
+}
+
+func TestJwtExpiry(t *testing.T) {
+	tests := []struct {
+		name    string
+		token   string
+		want    time.Time
+		wantErr bool
+	}{
+		{"exp claim", testJWT(`{"sub":"svc","exp":1700000000}`), time.Unix(1700000000, 0), false},
+		{"padded payload", "h." + base64.URLEncoding.EncodeToString([]byte(`{"exp": 1700000000}`)) + ".sig", time.Unix(1700000000, 0), false},
+		{"missing exp", testJWT(`{"sub":"svc"}`), time.Time{}, true},
+		{"zero exp", testJWT(`{"exp":0}`), time.Time{}, true},
+		{"string exp", testJWT(`{"exp":"soon"}`), time.Time{}, true},
+		{"not a JWT", "opaque-token", time.Time{}, true},
+		{"bad base64", "a.!!!.c", time.Time{}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := jwtExpiry(tt.token)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("jwtExpiry() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !got.Equal(tt.want) {
+				t.Errorf("jwtExpiry() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestResolveExpiry(t *testing.T) {
+	jwt := testJWT(`{"exp":1700000000}`)
+	fromJwt := config.TokenExtraction{ExpiryFromJwt: true}
+
+	before := time.Now()
+	got := resolveExpiry(60, jwt, fromJwt)
+	if got.Before(before.Add(60*time.Second)) || got.After(time.Now().Add(60*time.Second)) {
+		t.Errorf("expires_in 60: got %v, want about now+60s", got)
+	}
+
+	tests := []struct {
+		name       string
+		expiresIn  int64
+		token      string
+		extraction config.TokenExtraction
+		want       time.Time
+	}{
+		{"jwt exp", 0, jwt, fromJwt, time.Unix(1700000000, 0)},
+		{"negative expires_in falls back to jwt", -1, jwt, fromJwt, time.Unix(1700000000, 0)},
+		{"jwt not enabled", 0, jwt, config.TokenExtraction{}, time.Time{}},
+		{"jwt without exp", 0, testJWT(`{}`), fromJwt, time.Time{}},
+		{"opaque token", 0, "opaque-token", fromJwt, time.Time{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := resolveExpiry(tt.expiresIn, tt.token, tt.extraction); !got.Equal(tt.want) {
+				t.Errorf("resolveExpiry() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRefreshSkew(t *testing.T) {
+	issued := time.Unix(1700000000, 0)
+	tests := []struct {
+		name      string
+		skew      time.Duration
+		issuedAt  time.Time
+		expiresAt time.Time
+		want      time.Duration
+	}{
+		{"long lived token", 30 * time.Second, issued, issued.Add(time.Hour), 30 * time.Second},
+		{"lifetime equals skew", 30 * time.Second, issued, issued.Add(30 * time.Second), 15 * time.Second},
+		{"lifetime below skew", 30 * time.Second, issued, issued.Add(10 * time.Second), 5 * time.Second},
+		{"issue time unknown", 30 * time.Second, time.Time{}, issued.Add(10 * time.Second), 30 * time.Second},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := refreshSkew(tt.skew, tt.issuedAt, tt.expiresAt); got != tt.want {
+				t.Errorf("refreshSkew() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
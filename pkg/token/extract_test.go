@@ -0,0 +1,60 @@
+package token
+
+import (
+	"bst-auth/pkg/config"
+	"net/http"
+	"testing"
+)
+
+// extractFrom 按 source 从 headers 或 body 中提取 Token，name 为响应头或 Cookie 名称
+func extractFrom(headers http.Header, body string, source string, name string) (string, error) {
+	extraction := config.ValueExtraction{Source: source, HeaderName: name, CookieName: name}
+	return (&TokenManager{}).extractValue(headers, []byte(body), extraction, "datas")
+}
+
+func TestExtractFromHeadersAndCookies(t *testing.T) {
+	headers := http.Header{
+		"X-Auth-Token": {"header-token"},
+		"X-Empty":      {""},
+		"Set-Cookie": {
+			"theme=dark; Path=/",
+			"SESSION=cookie-token; Path=/; HttpOnly; Secure",
+			"EMPTY=; Path=/",
+		},
+	}
+	tests := []struct {
+		name    string
+		source  string
+		key     string
+		want    string
+		wantErr bool
+	}{
+		{name: "header", source: config.TokenSourceHeader, key: "X-Auth-Token", want: "header-token"},
+		{name: "header name is case-insensitive", source: config.TokenSourceHeader, key: "x-auth-token", want: "header-token"},
+		{name: "missing header", source: config.TokenSourceHeader, key: "X-Missing", wantErr: true},
+		{name: "empty header", source: config.TokenSourceHeader, key: "X-Empty", wantErr: true},
+		{name: "cookie among several", source: config.TokenSourceCookie, key: "SESSION", want: "cookie-token"},
+		{name: "cookie name is case-sensitive", source: config.TokenSourceCookie, key: "session", wantErr: true},
+		{name: "missing cookie", source: config.TokenSourceCookie, key: "TOKEN", wantErr: true},
+		{name: "empty cookie", source: config.TokenSourceCookie, key: "EMPTY", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := extractFrom(headers, `{"datas":"body-token"}`, tt.source, tt.key)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestExtractFromBodyByDefault(t *testing.T) {
+	headers := http.Header{"X-Auth-Token": {"header-token"}}
+	got, err := extractFrom(headers, `{"datas":"body-token"}`, "", "X-Auth-Token")
+	if err != nil || got != "body-token" {
+		t.Errorf("got %q, %v, want body-token", got, err)
+	}
+}
@@ -0,0 +1,120 @@
+package token
+
+import (
+	"bst-auth/pkg/config"
+	"encoding/json"
+	"errors"
+	"strings"
+
+	"github.com/higress-group/proxy-wasm-go-sdk/proxywasm"
+	"github.com/higress-group/wasm-go/pkg/log"
+)
+
+// 无法获取 Token 的原因，同时用作响应的 status code details
+const (
+	failureFetchFailed = "token.fetch.failed"
+	failureEmptyToken  = "token.empty"
+	failureCircuitOpen = "token.circuit.open"
+	// 配置了请求体注入但请求没有请求体（content-length 为 0 或只有请求头），token 无法注入
+	failureNoRequestBody = "token.inject.no_body"
+)
+
+// 修改当前请求的请求头，测试中替换为不依赖宿主的实现
+var (
+	replaceRequestHeader = proxywasm.ReplaceHttpRequestHeader
+	removeRequestHeader  = proxywasm.RemoveHttpRequestHeader
+)
+
+// failureReason 根据 token 请求的错误得到失败原因，err 为空表示拿到了空 Token
+func failureReason(err error) string {
+	switch {
+	case err == nil:
+		return failureEmptyToken
+	case errors.Is(err, ErrCircuitOpen):
+		return failureCircuitOpen
+	default:
+		return failureFetchFailed
+	}
+}
+
+// allowWithoutToken 按 on_token_failure 判断无法获取 Token 的请求是否放行，
+// allow_with_header 时给请求加上降级标记头，值为失败原因
+func allowWithoutToken(tokenConfig config.TokenConfig, reason string) bool {
+	switch tokenConfig.OnTokenFailure {
+	case config.OnTokenFailureAllow:
+		return true
+	case config.OnTokenFailureAllowWithHeader:
+		if err := replaceRequestHeader(config.DegradedHeader, reason); err != nil {
+			log.Warnf("添加降级标记头失败: %v", err)
+		}
+		return true
+	default:
+		return false
+	}
+}
+
+// stripDegradedHeader 删除客户端自带的降级标记头，避免上游把伪造的标记当真
+func stripDegradedHeader(tokenConfig config.TokenConfig) {
+	if tokenConfig.OnTokenFailure != config.OnTokenFailureAllowWithHeader {
+		return
+	}
+	_ = removeRequestHeader(config.DegradedHeader)
+}
+
+// ErrorReason 错误响应模板中 {reason} 的值：token 服务返回的错误信息，没有时为错误本身
+func ErrorReason(err error) string {
+	var serviceErr *TokenServiceError
+	if errors.As(err, &serviceErr) && serviceErr.Message != "" {
+		return serviceErr.Message
+	}
+	if err == nil {
+		return ""
+	}
+	return err.Error()
+}
+
+// sendKindResponse 返回 kind 对应的错误响应，未配置时返回不带响应体的 500
+func sendKindResponse(tokenConfig config.TokenConfig, kind string, detail string, reason string) error {
+	return SendErrorResponse(tokenConfig, kind, detail, reason, config.ErrorResponse{StatusCode: 500})
+}
+
+// SendErrorResponse 按 error_responses 中 kind 对应的配置返回错误响应，未配置时返回 fallback
+// detail 为响应的 status code details，reason 和请求的 x-request-id 会替换模板中的 {reason}、{request_id}
+func SendErrorResponse(tokenConfig config.TokenConfig, kind string, detail string, reason string, fallback config.ErrorResponse) error {
+	response, configured := tokenConfig.ErrorResponses[kind]
+	if !configured {
+		response = fallback
+	}
+
+	body := response.Body
+	var headers [][2]string
+	if configured {
+		requestID, _ := proxywasm.GetHttpRequestHeader("x-request-id")
+		plain := strings.NewReplacer("{reason}", reason, "{request_id}", requestID)
+		bodyReplacer := plain
+		if strings.Contains(response.Headers["content-type"], "json") {
+			// JSON 模板中的占位符一般写在字符串里，替换值需要转义
+			bodyReplacer = strings.NewReplacer("{reason}", jsonEscape(reason), "{request_id}", jsonEscape(requestID))
+		}
+		body = bodyReplacer.Replace(body)
+		for name, value := range response.Headers {
+			headers = append(headers, [2]string{name, plain.Replace(value)})
+		}
+	} else {
+		for name, value := range response.Headers {
+			headers = append(headers, [2]string{name, value})
+		}
+	}
+
+	var bodyBytes []byte
+	if body != "" {
+		bodyBytes = []byte(body)
+	}
+	return proxywasm.SendHttpResponseWithDetail(response.StatusCode, detail, headers, bodyBytes, -1)
+}
+
+// jsonEscape 把 s 转义为可以放进 JSON 字符串中的内容（不含两端引号）
+func jsonEscape(s string) string {
+	data, _ := json.Marshal(s)
+	return string(data[1 : len(data)-1])
+}
@@ -0,0 +1,126 @@
+package token
+
+import (
+	"bst-auth/pkg/config"
+	"errors"
+	"fmt"
+	"testing"
+)
+
+func TestErrorReason(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want string
+	}{
+		{"nil", nil, ""},
+		{"service message", &TokenServiceError{StatusCode: 400, Message: "invalid client"}, "invalid client"},
+		{"wrapped service message", fmt.Errorf("fetch: %w", &TokenServiceError{StatusCode: 400, Message: "invalid client"}), "invalid client"},
+		{"service without message", &TokenServiceError{StatusCode: 503}, "http 503"},
+		{"plain error", errors.New("dial failed"), "dial failed"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := ErrorReason(tt.err); got != tt.want {
+				t.Errorf("ErrorReason(%v) = %q, want %q", tt.err, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFailureReason(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want string
+	}{
+		{"empty token", nil, failureEmptyToken},
+		{"circuit open", ErrCircuitOpen, failureCircuitOpen},
+		{"fetch failed", errors.New("timeout"), failureFetchFailed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := failureReason(tt.err); got != tt.want {
+				t.Errorf("failureReason(%v) = %q, want %q", tt.err, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestJSONEscape(t *testing.T) {
+	tests := map[string]string{
+		`plain`:       `plain`,
+		`say "hi"`:    `say \"hi\"`,
+		"line\nbreak": `line\nbreak`,
+		`back\slash`:  `back\\slash`,
+		"<tag>&":      `\u003ctag\u003e\u0026`,
+	}
+	for in, want := range tests {
+		if got := jsonEscape(in); got != want {
+			t.Errorf("jsonEscape(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
+
+// fakeRequestHeaders 替换修改请求头的宿主调用，返回记录结果的请求头和恢复函数
+func fakeRequestHeaders() (map[string]string, func()) {
+	headers := map[string]string{config.DegradedHeader: "forged"}
+	origReplace, origRemove := replaceRequestHeader, removeRequestHeader
+	replaceRequestHeader = func(key, value string) error {
+		headers[key] = value
+		return nil
+	}
+	removeRequestHeader = func(key string) error {
+		delete(headers, key)
+		return nil
+	}
+	return headers, func() { replaceRequestHeader, removeRequestHeader = origReplace, origRemove }
+}
+
+func TestAllowWithoutToken(t *testing.T) {
+	tests := []struct {
+		onTokenFailure string
+		want           bool
+		wantHeader     string // 降级标记头的值，客户端自带的值为 forged
+	}{
+		{config.OnTokenFailureDeny, false, "forged"},
+		{config.OnTokenFailureAllow, true, "forged"},
+		{config.OnTokenFailureAllowWithHeader, true, failureCircuitOpen},
+	}
+	for _, tt := range tests {
+		t.Run(tt.onTokenFailure, func(t *testing.T) {
+			headers, restore := fakeRequestHeaders()
+			defer restore()
+
+			tokenConfig := config.TokenConfig{OnTokenFailure: tt.onTokenFailure}
+			if got := allowWithoutToken(tokenConfig, failureCircuitOpen); got != tt.want {
+				t.Errorf("allowWithoutToken() = %v, want %v", got, tt.want)
+			}
+			if got := headers[config.DegradedHeader]; got != tt.wantHeader {
+				t.Errorf("%s = %q, want %q", config.DegradedHeader, got, tt.wantHeader)
+			}
+		})
+	}
+}
+
+func TestStripDegradedHeader(t *testing.T) {
+	tests := []struct {
+		onTokenFailure string
+		wantStripped   bool
+	}{
+		{config.OnTokenFailureDeny, false},
+		{config.OnTokenFailureAllow, false},
+		{config.OnTokenFailureAllowWithHeader, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.onTokenFailure, func(t *testing.T) {
+			headers, restore := fakeRequestHeaders()
+			defer restore()
+
+			stripDegradedHeader(config.TokenConfig{OnTokenFailure: tt.onTokenFailure})
+			if _, present := headers[config.DegradedHeader]; present == tt.wantStripped {
+				t.Errorf("client %s present = %v, want stripped = %v", config.DegradedHeader, present, tt.wantStripped)
+			}
+		})
+	}
+}
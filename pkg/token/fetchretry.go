@@ -0,0 +1,149 @@
+package token
+
+import (
+	"bst-auth/pkg/config"
+	"bst-auth/pkg/scheduler"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"time"
+
+	"github.com/higress-group/wasm-go/pkg/log"
+)
+
+// 预估 token 请求总耗时时额外预留的时间（毫秒）
+const fetchBudgetMargin = 1000
+
+// FetchError 调用 token 服务没有拿到响应，Kind 为 config.FetchErrorTimeout 等错误类型
+type FetchError struct {
+	Kind string
+	Err  error
+}
+
+func (e *FetchError) Error() string {
+	if e.Err == nil {
+		return fmt.Sprintf("call failed: %s", e.Kind)
+	}
+	return fmt.Sprintf("call failed: %s: %v", e.Kind, e.Err)
+}
+
+func (e *FetchError) Unwrap() error {
+	return e.Err
+}
+
+// checkCallResult 判断 HttpCall 是否真正收到了响应
+// 超时、连接失败或被重置时 wrapper 以 502 回调，但响应头里没有 :status
+func checkCallResult(headers http.Header) error {
+	if headers.Get(":status") == "" {
+		return &FetchError{Kind: config.FetchErrorTimeout}
+	}
+	return nil
+}
+
+// dispatchFailed 请求没能发出（如集群不存在）
+func dispatchFailed(err error) error {
+	return &FetchError{Kind: config.FetchErrorDispatchFailed, Err: err}
+}
+
+// RequestTokenAsync 向 token 服务请求 Token，按 token_fetch_retry 重试可恢复的失败，
+// 所有尝试结束后只回调一次
+func (tm *TokenManager) RequestTokenAsync(config config.SimpleConfig, callback func(string, error)) {
+	tm.requestTokenAttempt(config, 1, callback)
+}
+
+func (tm *TokenManager) requestTokenAttempt(config config.SimpleConfig, attempt int, callback func(string, error)) {
+	tm.requestTokenOnce(config, func(token string, err error) {
+		tm.recordFetchResult(config.TokenConfig.CircuitBreaker, err)
+
+		fetchRetry := config.TokenConfig.FetchRetry
+		if err == nil || attempt >= fetchRetry.MaxAttempts || !isRetryableFetchError(err, fetchRetry) {
+			callback(token, err)
+			return
+		}
+		if tm.breakerRejects(config.TokenConfig.CircuitBreaker) {
+			// 本次失败触发了熔断，不再重试
+			callback(token, err)
+			return
+		}
+
+		delay := BackoffDelay(fetchRetry.Backoff, attempt)
+		log.Warnf("token 请求失败（第 %d/%d 次）: %v，%v 后重试", attempt, fetchRetry.MaxAttempts, err, delay)
+		scheduler.After(delay, func() {
+			tm.requestTokenAttempt(config, attempt+1, callback)
+		})
+	})
+}
+
+// isRetryableFetchError 错误是否属于 token_fetch_retry 中配置的可重试类型
+func isRetryableFetchError(err error, fetchRetry config.FetchRetry) bool {
+	var serviceErr *TokenServiceError
+	if errors.As(err, &serviceErr) {
+		// 200 但不满足 token_success_condition 属于业务拒绝，重试也无用
+		if serviceErr.StatusCode == 200 {
+			return false
+		}
+		for _, status := range fetchRetry.RetryableStatuses {
+			if status == serviceErr.StatusCode {
+				return true
+			}
+		}
+		return false
+	}
+
+	var fetchErr *FetchError
+	if errors.As(err, &fetchErr) {
+		for _, kind := range fetchRetry.RetryableErrors {
+			if kind == fetchErr.Kind {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// backoffMillis 第 attempt 次失败后不含随机浮动的等待时间：base_delay * 2^(attempt-1)，不超过 max_delay
+func backoffMillis(backoff config.Backoff, attempt int) float64 {
+	delay := float64(backoff.BaseDelay)
+	for i := 1; i < attempt && delay < float64(backoff.MaxDelay); i++ {
+		delay *= 2
+	}
+	if delay > float64(backoff.MaxDelay) {
+		delay = float64(backoff.MaxDelay)
+	}
+	return delay
+}
+
+// BackoffDelay 第 attempt 次失败后的等待时间，在 backoffMillis 的基础上加随机浮动
+func BackoffDelay(backoff config.Backoff, attempt int) time.Duration {
+	delay := backoffMillis(backoff, attempt)
+	if backoff.Jitter > 0 {
+		delay *= 1 + backoff.Jitter*(2*rand.Float64()-1)
+	}
+	return time.Duration(delay) * time.Millisecond
+}
+
+// recordRefreshResult 记录本 VM 一次 token 请求的结果，失败后按退避时间推迟下一次主动刷新，
+// 避免 token 服务不可用时每个 tick 都发起刷新
+func (tm *TokenManager) recordRefreshResult(backoff config.Backoff, err error) {
+	if err == nil {
+		tm.fetchFailures = 0
+		tm.refreshRetryAt = time.Time{}
+		return
+	}
+	tm.fetchFailures++
+	tm.refreshRetryAt = time.Now().Add(BackoffDelay(backoff, tm.fetchFailures))
+}
+
+// fetchBudget 一次 token 请求（含所有重试）最长可能的耗时，
+// 用于刷新租约的有效期和等待请求的超时时间
+func fetchBudget(tokenConfig config.TokenConfig) time.Duration {
+	fetchRetry := tokenConfig.FetchRetry
+	budget := float64(tokenConfig.Timeout) + fetchBudgetMargin
+	for i := 1; i < fetchRetry.MaxAttempts; i++ {
+		// 随机浮动按上限计算，延迟任务最多晚一个 tick 执行
+		budget += backoffMillis(fetchRetry.Backoff, i)*(1+fetchRetry.Jitter) + scheduler.TickPeriod
+		budget += float64(tokenConfig.Timeout)
+	}
+	return time.Duration(budget) * time.Millisecond
+}
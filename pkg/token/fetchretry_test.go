@@ -0,0 +1,119 @@
+package token
+
+import (
+	"bst-auth/pkg/config"
+	"bst-auth/pkg/scheduler"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestBackoffMillis(t *testing.T) {
+	backoff := config.Backoff{BaseDelay: 100, MaxDelay: 1000}
+	tests := []struct {
+		attempt int
+		want    float64
+	}{
+		{1, 100},
+		{2, 200},
+		{3, 400},
+		{4, 800},
+		{5, 1000},
+		{30, 1000},
+	}
+	for _, tt := range tests {
+		if got := backoffMillis(backoff, tt.attempt); got != tt.want {
+			t.Errorf("backoffMillis(attempt %d) = %v, want %v", tt.attempt, got, tt.want)
+		}
+	}
+
+	if got := backoffMillis(config.Backoff{BaseDelay: 0, MaxDelay: 1000}, 3); got != 0 {
+		t.Errorf("backoffMillis with zero base_delay = %v, want 0", got)
+	}
+	if got := backoffMillis(config.Backoff{BaseDelay: 500, MaxDelay: 200}, 1); got != 200 {
+		t.Errorf("backoffMillis with base_delay above max_delay = %v, want 200", got)
+	}
+}
+
+func TestBackoffDelayJitter(t *testing.T) {
+	backoff := config.Backoff{BaseDelay: 100, MaxDelay: 1000, Jitter: 0.5}
+	for i := 0; i < 100; i++ {
+		got := BackoffDelay(backoff, 2)
+		if got < 100*time.Millisecond || got > 300*time.Millisecond {
+			t.Fatalf("BackoffDelay(attempt 2, jitter 0.5) = %v, want within [100ms, 300ms]", got)
+		}
+	}
+
+	backoff.Jitter = 0
+	if got := BackoffDelay(backoff, 3); got != 400*time.Millisecond {
+		t.Errorf("BackoffDelay without jitter = %v, want 400ms", got)
+	}
+}
+
+func TestIsRetryableFetchError(t *testing.T) {
+	fetchRetry := config.FetchRetry{
+		RetryableStatuses: []int{429, 503},
+		RetryableErrors:   []string{config.FetchErrorTimeout},
+	}
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"retryable status", &TokenServiceError{StatusCode: 503}, true},
+		{"wrapped retryable status", fmt.Errorf("fetch: %w", &TokenServiceError{StatusCode: 429}), true},
+		{"other status", &TokenServiceError{StatusCode: 500}, false},
+		{"success condition not met", &TokenServiceError{StatusCode: 200, Message: "bad secret"}, false},
+		{"timeout", &FetchError{Kind: config.FetchErrorTimeout}, true},
+		{"dispatch failed", dispatchFailed(errors.New("no cluster")), false},
+		{"extraction failed", errors.New("extract failed"), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := isRetryableFetchError(tt.err, fetchRetry); got != tt.want {
+				t.Errorf("isRetryableFetchError(%v) = %v, want %v", tt.err, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFetchBudget(t *testing.T) {
+	tokenConfig := config.TokenConfig{Timeout: 1000}
+	tokenConfig.FetchRetry.MaxAttempts = 1
+	if got := fetchBudget(tokenConfig); got != 2000*time.Millisecond {
+		t.Errorf("fetchBudget without retries = %v, want 2s", got)
+	}
+
+	// 每次重试多一次超时和一次按最大浮动计算的退避，加一个 tick 的调度延迟
+	tokenConfig.FetchRetry = config.FetchRetry{
+		Backoff:     config.Backoff{BaseDelay: 100, MaxDelay: 1000, Jitter: 0.5},
+		MaxAttempts: 3,
+	}
+	want := time.Duration(1000+fetchBudgetMargin+
+		(100*1.5+scheduler.TickPeriod+1000)+
+		(200*1.5+scheduler.TickPeriod+1000)) * time.Millisecond
+	if got := fetchBudget(tokenConfig); got != want {
+		t.Errorf("fetchBudget with retries = %v, want %v", got, want)
+	}
+}
+
+func TestRecordRefreshResult(t *testing.T) {
+	backoff := config.Backoff{BaseDelay: 100, MaxDelay: 1000}
+	tm := &TokenManager{}
+
+	before := time.Now()
+	tm.recordRefreshResult(backoff, errors.New("unavailable"))
+	tm.recordRefreshResult(backoff, errors.New("unavailable"))
+	if tm.fetchFailures != 2 {
+		t.Fatalf("fetchFailures = %d, want 2", tm.fetchFailures)
+	}
+	if wait := tm.refreshRetryAt.Sub(before); wait < 200*time.Millisecond || wait > time.Second {
+		t.Errorf("refresh postponed by %v after 2 failures, want about 200ms", wait)
+	}
+
+	tm.recordRefreshResult(backoff, nil)
+	if tm.fetchFailures != 0 || !tm.refreshRetryAt.IsZero() {
+		t.Errorf("after success: fetchFailures = %d, refreshRetryAt = %v, want reset", tm.fetchFailures, tm.refreshRetryAt)
+	}
+}
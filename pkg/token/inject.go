@@ -0,0 +1,159 @@
+package token
+
+import (
+	"bst-auth/pkg/config"
+	"strings"
+
+	"github.com/higress-group/proxy-wasm-go-sdk/proxywasm"
+	"github.com/higress-group/wasm-go/pkg/log"
+)
+
+// InjectionRequest 注入 Token 的请求副本
+// 首次请求由宿主的请求头/请求体构造，重放请求直接使用保存的原始请求
+type InjectionRequest struct {
+	Headers [][2]string
+	Body    []byte
+}
+
+// injectionPhase 注入发生的阶段，首次请求的请求头和请求体在不同回调中处理
+type injectionPhase int
+
+const (
+	phaseHeaders injectionPhase = iota // 请求头阶段
+	phaseBody                          // 请求体阶段
+)
+
+// injector 一种 token_injection.type 的注入方式，同名的旧值（如原请求携带的过期 Token）会被覆盖
+type injector struct {
+	phase injectionPhase
+	apply func(tm *TokenManager, req *InjectionRequest, key string, value string)
+}
+
+// injectors 按 token_injection.type 注册的注入方式，首次请求和重放请求共用
+var injectors = map[string]injector{
+	"header":    {phase: phaseHeaders, apply: injectHeader},
+	"form_body": {phase: phaseBody, apply: injectFormBody},
+	"form":      {phase: phaseBody, apply: injectFormBody},
+}
+
+func injectHeader(tm *TokenManager, req *InjectionRequest, key string, value string) {
+	log.Debugf("将token注入到请求头: %s", key)
+	req.Headers = setHeader(req.Headers, key, value)
+}
+
+func injectFormBody(tm *TokenManager, req *InjectionRequest, key string, value string) {
+	log.Debugf("将token注入到表单体，键: %s", key)
+	req.Body = tm.addTokenToFormBody(req.Body, value, key)
+	// 请求体长度变了，原来的 content-length 不再可用
+	req.Headers = removeHeader(req.Headers, "content-length")
+}
+
+// applyInjections 把 token 按 token_injection 中属于 phases 阶段的配置写入 req，返回是否有改动
+func (tm *TokenManager) applyInjections(tokenConfig config.TokenConfig, token string, req *InjectionRequest, phases ...injectionPhase) bool {
+	if token == "" {
+		return false
+	}
+
+	replacer := tm.placeholderReplacer(token)
+	changed := false
+	for _, injection := range tokenConfig.TokenInjection {
+		inj, ok := injectors[injection.Type]
+		if !ok {
+			log.Warnf("未知的注入类型: %s", injection.Type)
+			continue
+		}
+		if !hasPhase(phases, inj.phase) {
+			continue
+		}
+		log.Debugf("根据配置注入token，类型: %s，键: %s，格式: %s", injection.Type, injection.Key, injection.Format)
+
+		// 替换格式中的{token}、{token_type}及 token_extraction.values 中的{名称}占位符
+		inj.apply(tm, req, injection.Key, replacer.Replace(injection.Format))
+		changed = true
+	}
+	return changed
+}
+
+// hasBodyInjection 是否配置了需要在请求体阶段注入的类型
+func hasBodyInjection(tokenConfig config.TokenConfig) bool {
+	for _, injection := range tokenConfig.TokenInjection {
+		if inj, ok := injectors[injection.Type]; ok && inj.phase == phaseBody {
+			return true
+		}
+	}
+	return false
+}
+
+func hasPhase(phases []injectionPhase, phase injectionPhase) bool {
+	for _, p := range phases {
+		if p == phase {
+			return true
+		}
+	}
+	return false
+}
+
+// InjectToken 请求头阶段：把 token 注入到当前请求的请求头，token 可能是 stale_while_revalidate 期间的旧 Token
+// 请求体阶段的注入由 InjectTokenBody 完成
+func (tm *TokenManager) InjectToken(config config.SimpleConfig, token string) {
+	log.Infof("开始注入token到请求中")
+
+	headers, err := proxywasm.GetHttpRequestHeaders()
+	if err != nil {
+		log.Warnf("读取请求头失败，无法注入token: %v", err)
+		return
+	}
+	req := &InjectionRequest{Headers: headers}
+	changed := tm.applyInjections(config.TokenConfig, token, req, phaseHeaders)
+	if hasBodyInjection(config.TokenConfig) {
+		// 请求体会在请求体阶段被改写
+		req.Headers = removeHeader(req.Headers, "content-length")
+		changed = true
+	}
+	if !changed {
+		return
+	}
+	if err := proxywasm.ReplaceHttpRequestHeaders(req.Headers); err != nil {
+		log.Warnf("注入token到请求头失败: %v", err)
+		return
+	}
+	log.Infof("Token注入完成")
+}
+
+// InjectTokenBody 请求体阶段：把 token 注入到当前请求的请求体
+func (tm *TokenManager) InjectTokenBody(config config.SimpleConfig, token string, body []byte) {
+	req := &InjectionRequest{Body: body}
+	if !tm.applyInjections(config.TokenConfig, token, req, phaseBody) {
+		return
+	}
+	if err := proxywasm.ReplaceHttpRequestBody(req.Body); err != nil {
+		log.Warnf("注入token到请求体失败: %v", err)
+		return
+	}
+	log.Infof("Token注入请求体完成")
+}
+
+// InjectInto 重放请求：按与首次请求相同的 token_injection 配置把 token 写入请求副本，
+// 覆盖原请求中携带的旧 Token
+func (tm *TokenManager) InjectInto(config config.SimpleConfig, token string, headers [][2]string, body []byte) ([][2]string, []byte) {
+	req := &InjectionRequest{Headers: headers, Body: body}
+	tm.applyInjections(config.TokenConfig, token, req, phaseHeaders, phaseBody)
+	return req.Headers, req.Body
+}
+
+// setHeader 设置请求头，删除所有同名（不区分大小写）的旧值
+func setHeader(headers [][2]string, name string, value string) [][2]string {
+	headers = removeHeader(headers, name)
+	return append(headers, [2]string{name, value})
+}
+
+// removeHeader 删除所有同名（不区分大小写）的请求头
+func removeHeader(headers [][2]string, name string) [][2]string {
+	result := headers[:0:0]
+	for _, h := range headers {
+		if !strings.EqualFold(h[0], name) {
+			result = append(result, h)
+		}
+	}
+	return result
+}
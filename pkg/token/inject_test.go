@@ -0,0 +1,101 @@
+package token
+
+import (
+	"bst-auth/pkg/config"
+	"net/url"
+	"reflect"
+	"testing"
+)
+
+func TestSetHeader(t *testing.T) {
+	headers := [][2]string{
+		{"authorization", "Bearer old"},
+		{"x-trace", "1"},
+		{"Authorization", "Bearer older"},
+	}
+	got := setHeader(headers, "Authorization", "Bearer new")
+	want := [][2]string{{"x-trace", "1"}, {"Authorization", "Bearer new"}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("setHeader() = %v, want %v", got, want)
+	}
+	if len(headers) != 3 || headers[0][1] != "Bearer old" {
+		t.Errorf("setHeader() modified its input: %v", headers)
+	}
+}
+
+func TestRemoveHeader(t *testing.T) {
+	headers := [][2]string{{"Content-Length", "10"}, {"content-type", "text/plain"}}
+	got := removeHeader(headers, "content-length")
+	want := [][2]string{{"content-type", "text/plain"}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("removeHeader() = %v, want %v", got, want)
+	}
+}
+
+func TestInjectInto(t *testing.T) {
+	tm := &TokenManager{tokenType: "Bearer", values: map[string]string{"tenant": "t-1"}}
+	cfg := config.SimpleConfig{TokenConfig: config.TokenConfig{TokenInjection: []config.TokenInjection{
+		{Type: "header", Key: "Authorization", Format: "{token_type} {token}"},
+		{Type: "header", Key: "x-tenant", Format: "{tenant}"},
+		{Type: "form_body", Key: "access_token", Format: "{token}"},
+		{Type: "unknown", Key: "ignored", Format: "{token}"},
+	}}}
+	headers := [][2]string{
+		{"authorization", "Bearer stale"},
+		{"content-type", "application/x-www-form-urlencoded"},
+		{"content-length", "23"},
+	}
+	body := []byte("name=alice&access_token=stale")
+
+	gotHeaders, gotBody := tm.InjectInto(cfg, "fresh", headers, body)
+
+	wantHeaders := [][2]string{
+		{"content-type", "application/x-www-form-urlencoded"},
+		{"Authorization", "Bearer fresh"},
+		{"x-tenant", "t-1"},
+	}
+	if !reflect.DeepEqual(gotHeaders, wantHeaders) {
+		t.Errorf("headers = %v, want %v", gotHeaders, wantHeaders)
+	}
+	form, err := url.ParseQuery(string(gotBody))
+	if err != nil {
+		t.Fatalf("body %q is not a form: %v", gotBody, err)
+	}
+	wantForm := url.Values{"name": {"alice"}, "access_token": {"fresh"}}
+	if !reflect.DeepEqual(form, wantForm) {
+		t.Errorf("body = %v, want %v", form, wantForm)
+	}
+}
+
+func TestInjectIntoEmptyToken(t *testing.T) {
+	tm := &TokenManager{}
+	cfg := config.SimpleConfig{TokenConfig: config.TokenConfig{TokenInjection: []config.TokenInjection{
+		{Type: "header", Key: "Authorization", Format: "Bearer {token}"},
+	}}}
+	headers := [][2]string{{"authorization", "Bearer stale"}}
+	gotHeaders, gotBody := tm.InjectInto(cfg, "", headers, []byte("a=1"))
+	if !reflect.DeepEqual(gotHeaders, headers) || string(gotBody) != "a=1" {
+		t.Errorf("InjectInto with empty token = %v, %q, want the request unchanged", gotHeaders, gotBody)
+	}
+}
+
+func TestHasBodyInjection(t *testing.T) {
+	tests := []struct {
+		types []string
+		want  bool
+	}{
+		{nil, false},
+		{[]string{"header"}, false},
+		{[]string{"header", "form_body"}, true},
+		{[]string{"form"}, true},
+	}
+	for _, tt := range tests {
+		var tokenConfig config.TokenConfig
+		for _, typ := range tt.types {
+			tokenConfig.TokenInjection = append(tokenConfig.TokenInjection, config.TokenInjection{Type: typ, Key: "k"})
+		}
+		if got := hasBodyInjection(tokenConfig); got != tt.want {
+			t.Errorf("hasBodyInjection(%v) = %v, want %v", tt.types, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,32 @@
+package token
+
+import (
+	"os"
+	"testing"
+
+	"github.com/higress-group/wasm-go/pkg/log"
+)
+
+// discardLog 测试中丢弃插件日志，宿主环境之外 wrapper 不会设置日志
+type discardLog struct{}
+
+func (discardLog) Trace(string)                     {}
+func (discardLog) Tracef(string, ...interface{})    {}
+func (discardLog) Debug(string)                     {}
+func (discardLog) Debugf(string, ...interface{})    {}
+func (discardLog) Info(string)                      {}
+func (discardLog) Infof(string, ...interface{})     {}
+func (discardLog) Warn(string)                      {}
+func (discardLog) Warnf(string, ...interface{})     {}
+func (discardLog) Error(string)                     {}
+func (discardLog) Errorf(string, ...interface{})    {}
+func (discardLog) Critical(string)                  {}
+func (discardLog) Criticalf(string, ...interface{}) {}
+func (discardLog) ResetID(string)                   {}
+
+func TestMain(m *testing.M) {
+	log.SetPluginLog(discardLog{})
+	// 宿主环境之外没有可切换的上下文，记录了上下文 ID 即视为切换成功
+	setEffectiveContext = func(uint32) error { return nil }
+	os.Exit(m.Run())
+}
@@ -0,0 +1,80 @@
+package token
+
+import (
+	"bst-auth/pkg/config"
+	"encoding/base64"
+	"fmt"
+	"net/url"
+
+	"github.com/tidwall/gjson"
+)
+
+const defaultTokenType = "Bearer"
+
+// oauth2Token 标准 OAuth2 token 响应（RFC 6749 5.1）
+type oauth2Token struct {
+	AccessToken string
+	TokenType   string
+	ExpiresIn   int64
+}
+
+// isClientCredentials 是否使用 OAuth2 client_credentials 模式获取 Token
+func isClientCredentials(tokenConfig config.TokenConfig) bool {
+	return tokenConfig.GrantType == config.GrantTypeClientCredentials
+}
+
+// buildClientCredentialsRequest 构建 client_credentials 模式的请求头和表单体
+func buildClientCredentialsRequest(credential config.Credential) ([][2]string, []byte) {
+	formData := make(url.Values)
+	for k, v := range credential.FormFields {
+		formData.Set(k, v)
+	}
+	formData.Set("grant_type", config.GrantTypeClientCredentials)
+	if credential.Scope != "" {
+		formData.Set("scope", credential.Scope)
+	}
+	if credential.Audience != "" {
+		formData.Set("audience", credential.Audience)
+	}
+
+	headers := [][2]string{
+		{"content-type", "application/x-www-form-urlencoded"},
+		{"accept", "application/json"},
+	}
+	for k, v := range credential.HeadFields {
+		headers = append(headers, [2]string{k, v})
+	}
+
+	switch credential.AuthMethod {
+	case config.AuthMethodClientSecretPost:
+		formData.Set("client_id", credential.ClientID)
+		formData.Set("client_secret", credential.ClientSecret)
+	default:
+		// RFC 6749 2.3.1：client_id 和 client_secret 需先做 form 编码再 base64
+		userPass := url.QueryEscape(credential.ClientID) + ":" + url.QueryEscape(credential.ClientSecret)
+		headers = append(headers, [2]string{"authorization", "Basic " + base64.StdEncoding.EncodeToString([]byte(userPass))})
+	}
+
+	return headers, []byte(formData.Encode())
+}
+
+// parseOAuth2Response 解析标准 OAuth2 token 响应，错误响应已由 checkTokenResponse 处理
+func parseOAuth2Response(body []byte) (oauth2Token, error) {
+	if !gjson.ValidBytes(body) {
+		return oauth2Token{}, fmt.Errorf("invalid json response")
+	}
+	response := gjson.ParseBytes(body)
+
+	token := oauth2Token{
+		AccessToken: response.Get("access_token").String(),
+		TokenType:   response.Get("token_type").String(),
+		ExpiresIn:   response.Get("expires_in").Int(),
+	}
+	if token.AccessToken == "" {
+		return oauth2Token{}, fmt.Errorf("access_token not found in response")
+	}
+	if token.TokenType == "" {
+		token.TokenType = defaultTokenType
+	}
+	return token, nil
+}
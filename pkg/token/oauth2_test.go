@@ -0,0 +1,140 @@
+package token
+
+import (
+	"bst-auth/pkg/config"
+	"encoding/base64"
+	"net/url"
+	"testing"
+)
+
+// headerValue 返回 headers 中 name 的第一个值
+func headerValue(headers [][2]string, name string) (string, bool) {
+	for _, h := range headers {
+		if h[0] == name {
+			return h[1], true
+		}
+	}
+	return "", false
+}
+
+func TestBuildClientCredentialsRequest(t *testing.T) {
+	tests := []struct {
+		name       string
+		credential config.Credential
+		wantAuth   string // 期望的 Basic 凭证解码后的内容，空表示不应有 authorization 头
+		wantForm   url.Values
+	}{
+		{
+			name:       "basic auth by default",
+			credential: config.Credential{ClientID: "svc", ClientSecret: "secret"},
+			wantAuth:   "svc:secret",
+			wantForm:   url.Values{"grant_type": {"client_credentials"}},
+		},
+		{
+			name:       "basic auth escapes id and secret",
+			credential: config.Credential{ClientID: "svc:a b", ClientSecret: "p@ss/w+rd", AuthMethod: config.AuthMethodClientSecretBasic},
+			wantAuth:   "svc%3Aa+b:p%40ss%2Fw%2Brd",
+			wantForm:   url.Values{"grant_type": {"client_credentials"}},
+		},
+		{
+			name: "post auth with scope and audience",
+			credential: config.Credential{
+				ClientID: "svc", ClientSecret: "a&b=c", AuthMethod: config.AuthMethodClientSecretPost,
+				Scope: "read write", Audience: "https://api.example.com",
+			},
+			wantForm: url.Values{
+				"grant_type":    {"client_credentials"},
+				"client_id":     {"svc"},
+				"client_secret": {"a&b=c"},
+				"scope":         {"read write"},
+				"audience":      {"https://api.example.com"},
+			},
+		},
+		{
+			name: "grant_type cannot be overridden by form_fields",
+			credential: config.Credential{
+				ClientID: "svc", ClientSecret: "secret",
+				FormFields: map[string]string{"grant_type": "password", "resource": "api"},
+			},
+			wantAuth: "svc:secret",
+			wantForm: url.Values{"grant_type": {"client_credentials"}, "resource": {"api"}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			headers, body := buildClientCredentialsRequest(tt.credential)
+
+			if got, _ := headerValue(headers, "content-type"); got != "application/x-www-form-urlencoded" {
+				t.Errorf("content-type = %q", got)
+			}
+			auth, ok := headerValue(headers, "authorization")
+			if tt.wantAuth == "" {
+				if ok {
+					t.Errorf("unexpected authorization header %q", auth)
+				}
+			} else {
+				want := "Basic " + base64.StdEncoding.EncodeToString([]byte(tt.wantAuth))
+				if auth != want {
+					t.Errorf("authorization = %q, want %q", auth, want)
+				}
+			}
+
+			form, err := url.ParseQuery(string(body))
+			if err != nil {
+				t.Fatalf("body %q is not a form: %v", body, err)
+			}
+			if form.Encode() != tt.wantForm.Encode() {
+				t.Errorf("form = %v, want %v", form, tt.wantForm)
+			}
+		})
+	}
+}
+
+func TestBuildClientCredentialsRequestHeadFields(t *testing.T) {
+	headers, _ := buildClientCredentialsRequest(config.Credential{
+		ClientID: "svc", ClientSecret: "secret",
+		HeadFields: map[string]string{"x-tenant": "t1"},
+	})
+	if got, _ := headerValue(headers, "x-tenant"); got != "t1" {
+		t.Errorf("x-tenant = %q, want t1", got)
+	}
+}
+
+func TestParseOAuth2Response(t *testing.T) {
+	tests := []struct {
+		name    string
+		body    string
+		want    oauth2Token
+		wantErr string
+	}{
+		{
+			name: "full response",
+			body: `{"access_token":"abc","token_type":"mac","expires_in":3600}`,
+			want: oauth2Token{AccessToken: "abc", TokenType: "mac", ExpiresIn: 3600},
+		},
+		{
+			name: "token_type defaults to Bearer",
+			body: `{"access_token":"abc"}`,
+			want: oauth2Token{AccessToken: "abc", TokenType: "Bearer"},
+		},
+		{name: "missing access_token", body: `{"token_type":"Bearer"}`, wantErr: "access_token not found in response"},
+		{name: "invalid json", body: `access_token=abc`, wantErr: "invalid json response"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseOAuth2Response([]byte(tt.body))
+			if tt.wantErr != "" {
+				if err == nil || err.Error() != tt.wantErr {
+					t.Fatalf("error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
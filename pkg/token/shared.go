@@ -0,0 +1,265 @@
+package token
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/higress-group/proxy-wasm-go-sdk/proxywasm"
+	"github.com/higress-group/proxy-wasm-go-sdk/proxywasm/types"
+	"github.com/higress-group/wasm-go/pkg/log"
+)
+
+const (
+	sharedTokenKeyPrefix = "ext-auth-wasm:token:"
+	sharedLeaseKeyPrefix = "ext-auth-wasm:token-lease:"
+
+	// WaitTickPeriod 等待其他 VM 刷新 Token 时轮询共享数据的周期（毫秒）
+	WaitTickPeriod = 100
+
+	// 刷新租约的最短有效期，避免持有者异常退出后其他 VM 长时间等待
+	minLeaseMillis = 3000
+	// CAS 冲突时的最大重试次数
+	maxCasRetries = 3
+)
+
+// sharedToken 保存在 proxy-wasm 共享数据中的 Token，所有 worker VM 共用
+type sharedToken struct {
+	Token     string `json:"token"`
+	TokenType string `json:"token_type"`
+	ExpiresAt int64  `json:"expires_at"`         // 毫秒时间戳，0 表示未知
+	IssuedAt  int64  `json:"issued_at"`          // 获取时间，毫秒时间戳
+	StaleAt   int64  `json:"stale_at,omitempty"` // 被上游拒绝的时间，毫秒时间戳
+
+	Values map[string]string `json:"values,omitempty"` // 随 Token 一起提取的其他值
+}
+
+// refreshLease 刷新租约，同一时间只有持有租约的 VM 会请求 token 服务
+type refreshLease struct {
+	VMID      string `json:"vm_id"`
+	ExpiresAt int64  `json:"expires_at"` // 毫秒时间戳
+}
+
+// held 租约在 now（毫秒时间戳）时是否仍被某个 VM 持有
+func (l refreshLease) held(now int64) bool {
+	return l.VMID != "" && now < l.ExpiresAt
+}
+
+// newLease 当前 VM 在 now 时获取的租约，有效期不短于 minLeaseMillis
+func newLease(now int64, ttl time.Duration) refreshLease {
+	ttlMillis := ttl.Milliseconds()
+	if ttlMillis < minLeaseMillis {
+		ttlMillis = minLeaseMillis
+	}
+	return refreshLease{VMID: vmID, ExpiresAt: now + ttlMillis}
+}
+
+// vmID 当前 VM 的随机标识，用于刷新租约
+var vmID = newVMID()
+
+// newVMID 生成当前 VM 的随机标识
+func newVMID() string {
+	buf := make([]byte, 8)
+	if _, err := rand.Read(buf); err != nil {
+		return hex.EncodeToString([]byte(time.Now().String()))
+	}
+	return hex.EncodeToString(buf)
+}
+
+func unixMilli(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.UnixMilli()
+}
+
+func fromUnixMilli(ms int64) time.Time {
+	if ms == 0 {
+		return time.Time{}
+	}
+	return time.UnixMilli(ms)
+}
+
+// loadSharedData 读取共享数据原始内容，不存在时返回 nil 和 cas 0
+func loadSharedData(key string) ([]byte, uint32, error) {
+	data, cas, err := proxywasm.GetSharedData(key)
+	if errors.Is(err, types.ErrorStatusNotFound) {
+		return nil, 0, nil
+	}
+	return data, cas, err
+}
+
+// loadSharedToken 读取共享数据中的 Token，不存在时返回零值
+func loadSharedToken(key string) (sharedToken, uint32, error) {
+	var entry sharedToken
+	data, cas, err := proxywasm.GetSharedData(key)
+	if err != nil {
+		if errors.Is(err, types.ErrorStatusNotFound) {
+			return entry, cas, nil
+		}
+		return entry, cas, err
+	}
+	if len(data) == 0 {
+		return entry, cas, nil
+	}
+	if err := json.Unmarshal(data, &entry); err != nil {
+		return sharedToken{}, cas, err
+	}
+	return entry, cas, nil
+}
+
+// seedSharedKey 共享数据中还没有 key 时写入空值
+// 对不存在的键以 cas 0 写入总会成功，多个 VM 同时首次写入时会互相覆盖，
+// 因此插件启动时先创建各个键，之后的写入只使用非零 cas
+func seedSharedKey(key string) error {
+	_, _, err := proxywasm.GetSharedData(key)
+	if err == nil || !errors.Is(err, types.ErrorStatusNotFound) {
+		return err
+	}
+	// 空值对读取方等同于不存在，多个 VM 同时写入也没有影响
+	return proxywasm.SetSharedData(key, nil, 0)
+}
+
+// SeedSharedData 创建 TokenManager 使用的共享数据键，插件启动时调用
+func (tm *TokenManager) SeedSharedData() {
+	for _, key := range []string{tm.sharedTokenKey, tm.sharedLeaseKey, tm.sharedBreakerKey} {
+		if err := seedSharedKey(key); err != nil {
+			log.Warnf("初始化共享数据 %s 失败: %v", key, err)
+		}
+	}
+}
+
+// loadSeeded 用 load 读取 key，key 尚未创建时先创建再重新读取，保证返回的 cas 非零
+func loadSeeded[T any](key string, load func(string) (T, uint32, error)) (T, uint32, error) {
+	value, cas, err := load(key)
+	if err != nil || cas != 0 {
+		return value, cas, err
+	}
+	if err := seedSharedKey(key); err != nil {
+		return value, 0, err
+	}
+	return load(key)
+}
+
+// storeSharedToken 写入共享数据，CAS 冲突时重新读取后重试
+func storeSharedToken(key string, entry sharedToken) error {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	for i := 0; i < maxCasRetries; i++ {
+		_, cas, err := loadSeeded(key, loadSharedData)
+		if err != nil {
+			return err
+		}
+		err = proxywasm.SetSharedData(key, data, cas)
+		if err == nil {
+			return nil
+		}
+		if !errors.Is(err, types.ErrorStatusCasMismatch) {
+			return err
+		}
+	}
+	return types.ErrorStatusCasMismatch
+}
+
+// invalidateSharedToken 仅当共享数据中仍是 staleToken 时才清空，
+// 避免多个 VM 同时发现同一个失效 Token 时把别人刚刷新好的 Token 清掉
+// keepStale 为 true 时不清空，只记录被拒绝的时间
+func invalidateSharedToken(key string, staleToken string, keepStale bool) error {
+	for i := 0; i < maxCasRetries; i++ {
+		entry, cas, err := loadSharedToken(key)
+		if err != nil {
+			return err
+		}
+		// cas 为 0 说明键不存在，没有需要清空的 Token
+		if cas == 0 || entry.Token == "" || entry.Token != staleToken {
+			return nil
+		}
+		if keepStale && entry.StaleAt != 0 {
+			return nil
+		}
+		replacement := sharedToken{}
+		if keepStale {
+			replacement = entry
+			replacement.StaleAt = time.Now().UnixMilli()
+		}
+		data, _ := json.Marshal(replacement)
+		err = proxywasm.SetSharedData(key, data, cas)
+		if err == nil {
+			return nil
+		}
+		if !errors.Is(err, types.ErrorStatusCasMismatch) {
+			return err
+		}
+	}
+	return types.ErrorStatusCasMismatch
+}
+
+// loadLease 读取刷新租约，不存在时返回零值
+func loadLease(key string) (refreshLease, uint32, error) {
+	var lease refreshLease
+	data, cas, err := proxywasm.GetSharedData(key)
+	if err != nil {
+		if errors.Is(err, types.ErrorStatusNotFound) {
+			return lease, cas, nil
+		}
+		return lease, cas, err
+	}
+	if len(data) == 0 {
+		return lease, cas, nil
+	}
+	if err := json.Unmarshal(data, &lease); err != nil {
+		// 数据损坏时视为无人持有
+		return refreshLease{}, cas, nil
+	}
+	return lease, cas, nil
+}
+
+// leaseAvailable 租约是否空闲（无人持有或已过期）
+func leaseAvailable(key string) bool {
+	lease, _, err := loadLease(key)
+	if err != nil {
+		log.Warnf("读取刷新租约失败: %v", err)
+		return true
+	}
+	return !lease.held(time.Now().UnixMilli())
+}
+
+// tryAcquireLease 尝试获取刷新租约，ttl 为本次 token 请求最长可能的耗时，成功返回 true
+func tryAcquireLease(key string, ttl time.Duration) bool {
+	lease, cas, err := loadSeeded(key, loadLease)
+	if err != nil {
+		log.Warnf("读取刷新租约失败: %v", err)
+		return false
+	}
+	if cas == 0 {
+		// 以 cas 0 写入是无条件覆盖，多个 VM 会同时拿到租约
+		return false
+	}
+	now := time.Now().UnixMilli()
+	if lease.held(now) {
+		return false
+	}
+
+	data, _ := json.Marshal(newLease(now, ttl))
+	if err := proxywasm.SetSharedData(key, data, cas); err != nil {
+		log.Debugf("获取刷新租约失败: %v", err)
+		return false
+	}
+	return true
+}
+
+// releaseLease 释放当前 VM 持有的刷新租约
+func releaseLease(key string) {
+	lease, cas, err := loadLease(key)
+	if err != nil || cas == 0 || lease.VMID != vmID {
+		return
+	}
+	data, _ := json.Marshal(refreshLease{})
+	if err := proxywasm.SetSharedData(key, data, cas); err != nil {
+		log.Debugf("释放刷新租约失败: %v", err)
+	}
+}
@@ -0,0 +1,54 @@
+package token
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRefreshLeaseHeld(t *testing.T) {
+	const now = int64(1_000_000)
+	tests := []struct {
+		name  string
+		lease refreshLease
+		want  bool
+	}{
+		{"never acquired", refreshLease{}, false},
+		{"released", refreshLease{ExpiresAt: now + 1000}, false},
+		{"held", refreshLease{VMID: "vm-1", ExpiresAt: now + 1}, true},
+		{"expires now", refreshLease{VMID: "vm-1", ExpiresAt: now}, false},
+		{"expired", refreshLease{VMID: "vm-1", ExpiresAt: now - 1}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.lease.held(now); got != tt.want {
+				t.Errorf("held() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNewLease(t *testing.T) {
+	const now = int64(1_000_000)
+	lease := newLease(now, 10*time.Second)
+	if lease.VMID != vmID || lease.ExpiresAt != now+10000 {
+		t.Errorf("newLease(10s) = %+v, want held by %s until %d", lease, vmID, now+10000)
+	}
+	if !lease.held(now + 9999) {
+		t.Errorf("lease not held before it expires")
+	}
+
+	// 有效期不短于 minLeaseMillis
+	if lease := newLease(now, time.Millisecond); lease.ExpiresAt != now+minLeaseMillis {
+		t.Errorf("newLease(1ms).ExpiresAt = %d, want %d", lease.ExpiresAt, now+minLeaseMillis)
+	}
+}
+
+func TestSharedTokenMillis(t *testing.T) {
+	if !fromUnixMilli(0).IsZero() || unixMilli(time.Time{}) != 0 {
+		t.Errorf("zero time does not round-trip through 0")
+	}
+	at := time.UnixMilli(1_700_000_000_123)
+	if got := fromUnixMilli(unixMilli(at)); !got.Equal(at) {
+		t.Errorf("fromUnixMilli(unixMilli(%v)) = %v", at, got)
+	}
+}
@@ -0,0 +1,64 @@
+package token
+
+import (
+	"bst-auth/pkg/config"
+	"time"
+
+	"github.com/higress-group/wasm-go/pkg/log"
+)
+
+// keepsStaleToken 是否配置了 stale_while_revalidate 或 stale_if_error，
+// 配置后 Token 过期或被上游拒绝时保留旧 Token
+func keepsStaleToken(tokenConfig config.TokenConfig) bool {
+	return tokenConfig.StaleWhileRevalidate > 0 || tokenConfig.StaleIfError > 0
+}
+
+// staleSince Token 在 now 时开始不可用的时间（过期或被上游拒绝，取较早者），Token 仍可用时返回零值
+// 调用方需持有 tokenMutex
+func (tm *TokenManager) staleSince(now time.Time) time.Time {
+	since := tm.staleAt
+	if !tm.expiresAt.IsZero() && !now.Before(tm.expiresAt) {
+		if since.IsZero() || tm.expiresAt.Before(since) {
+			since = tm.expiresAt
+		}
+	}
+	return since
+}
+
+// GetStaleToken 获取仍在宽限期内的旧 Token，没有时返回空字符串
+// 宽限期为 stale_while_revalidate；afterError 为 true（刷新失败）时为 stale_while_revalidate 与 stale_if_error 中较长者
+func (tm *TokenManager) GetStaleToken(tokenConfig config.TokenConfig, afterError bool) string {
+	tm.syncFromShared()
+
+	tm.tokenMutex.RLock()
+	defer tm.tokenMutex.RUnlock()
+	return tm.staleToken(tokenConfig, afterError, time.Now())
+}
+
+// staleToken now 时仍在宽限期内的旧 Token，调用方需持有 tokenMutex
+func (tm *TokenManager) staleToken(tokenConfig config.TokenConfig, afterError bool, now time.Time) string {
+	since := tm.staleSince(now)
+	if tm.token == "" || since.IsZero() {
+		return ""
+	}
+
+	grace := tokenConfig.StaleWhileRevalidate
+	if afterError && tokenConfig.StaleIfError > grace {
+		grace = tokenConfig.StaleIfError
+	}
+	if now.Sub(since) >= time.Duration(grace)*time.Second {
+		return ""
+	}
+	return tm.token
+}
+
+// revalidate 在后台刷新 Token，当前请求继续使用旧 Token
+// 本 VM 已有 token 请求、其他 VM 持有刷新租约或 token 服务熔断中时不重复发起
+func (tm *TokenManager) revalidate(config config.SimpleConfig) {
+	if tm.fetching || tm.breakerRejects(config.TokenConfig.CircuitBreaker) {
+		return
+	}
+	if tm.startFetch(config) {
+		log.Infof("旧 Token 宽限期内，后台刷新 Token")
+	}
+}
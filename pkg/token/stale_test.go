@@ -0,0 +1,69 @@
+package token
+
+import (
+	"bst-auth/pkg/config"
+	"testing"
+	"time"
+)
+
+func TestStaleSince(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	tests := []struct {
+		name      string
+		expiresAt time.Time
+		staleAt   time.Time
+		want      time.Time
+	}{
+		{"valid", now.Add(time.Minute), time.Time{}, time.Time{}},
+		{"expiry unknown", time.Time{}, time.Time{}, time.Time{}},
+		{"expired", now.Add(-time.Minute), time.Time{}, now.Add(-time.Minute)},
+		{"expires now", now, time.Time{}, now},
+		{"rejected before expiry", now.Add(time.Minute), now.Add(-time.Second), now.Add(-time.Second)},
+		{"rejected after expiry", now.Add(-time.Minute), now.Add(-time.Second), now.Add(-time.Minute)},
+		{"expired after rejection", now.Add(-time.Second), now.Add(-time.Minute), now.Add(-time.Minute)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tm := &TokenManager{token: "t", expiresAt: tt.expiresAt, staleAt: tt.staleAt}
+			if got := tm.staleSince(now); !got.Equal(tt.want) {
+				t.Errorf("staleSince() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestStaleToken(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	tokenConfig := config.TokenConfig{StaleWhileRevalidate: 10, StaleIfError: 60}
+	tests := []struct {
+		name       string
+		token      string
+		staleFor   time.Duration // 0 表示 Token 仍可用
+		afterError bool
+		config     config.TokenConfig
+		want       string
+	}{
+		{name: "token still valid", token: "t", config: tokenConfig, want: ""},
+		{name: "no token", token: "", staleFor: time.Second, config: tokenConfig, want: ""},
+		{name: "within stale_while_revalidate", token: "t", staleFor: 5 * time.Second, config: tokenConfig, want: "t"},
+		{name: "stale_while_revalidate ended", token: "t", staleFor: 10 * time.Second, config: tokenConfig, want: ""},
+		{name: "stale_if_error after failed refresh", token: "t", staleFor: 30 * time.Second, afterError: true, config: tokenConfig, want: "t"},
+		{name: "stale_if_error ended", token: "t", staleFor: 60 * time.Second, afterError: true, config: tokenConfig, want: ""},
+		{
+			name: "longer stale_while_revalidate applies after error", token: "t", staleFor: 30 * time.Second, afterError: true,
+			config: config.TokenConfig{StaleWhileRevalidate: 45, StaleIfError: 20}, want: "t",
+		},
+		{name: "windows not configured", token: "t", staleFor: time.Millisecond, afterError: true, config: config.TokenConfig{}, want: ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tm := &TokenManager{token: tt.token, expiresAt: now.Add(time.Hour)}
+			if tt.staleFor > 0 {
+				tm.staleAt = now.Add(-tt.staleFor)
+			}
+			if got := tm.staleToken(tt.config, tt.afterError, now); got != tt.want {
+				t.Errorf("staleToken() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
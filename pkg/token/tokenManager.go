@@ -3,108 +3,289 @@ package token
 
 import (
 	"bst-auth/pkg/config"
-	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
 	"net/url"
 	"strings"
 	"sync"
+	"time"
 
-	"github.com/expr-lang/expr"
 	"github.com/higress-group/proxy-wasm-go-sdk/proxywasm"
 	"github.com/higress-group/proxy-wasm-go-sdk/proxywasm/types"
 	"github.com/higress-group/wasm-go/pkg/log"
+	"github.com/higress-group/wasm-go/pkg/wrapper"
+	"github.com/tidwall/gjson"
 )
 
-var (
-	globalTokenManager *TokenManager
-	once               sync.Once
-)
+// tokenManagers 按 Token 缓存标识区分的 TokenManager，
+// token_service/credential 相同的路由共用一份缓存，不同的互不影响
+var tokenManagers = make(map[string]*TokenManager)
 
-// GetTokenManager 获取全局唯一的 TokenManager
-func GetTokenManager() *TokenManager {
-	once.Do(func() {
-		globalTokenManager = &TokenManager{
-			token:        "",             // 当前 Token
-			tokenMutex:   sync.RWMutex{}, // 保护 token 读写
-			refreshMutex: sync.Mutex{},   // 防止并发刷新（关键！）
+// GetTokenManager 获取配置对应的 TokenManager
+func GetTokenManager(config config.SimpleConfig) *TokenManager {
+	key := config.TokenConfig.CacheKey
+	tm, ok := tokenManagers[key]
+	if !ok {
+		tm = &TokenManager{
+			token:            "",                           // 当前 Token
+			sharedTokenKey:   sharedTokenKeyPrefix + key,   // 共享数据中 Token 的键
+			sharedLeaseKey:   sharedLeaseKeyPrefix + key,   // 共享数据中刷新租约的键
+			sharedBreakerKey: sharedBreakerKeyPrefix + key, // 共享数据中熔断器状态的键
+			tokenMutex:       sync.RWMutex{},               // 保护 token 读写
 		}
-	})
-	return globalTokenManager
+		tokenManagers[key] = tm
+	}
+	return tm
 }
 
-// TokenManager 管理全局 Token
+// TokenManager 管理一个 token 服务 + 凭证组合对应的 Token
 // ✅ 设计原则：
 //   - tokenMutex: 保护 token 变量本身（数据安全）
-//   - refreshMutex: 保护“刷新行为”不被重复执行（行为安全）
+//   - Wasm VM 是单线程的，“同一时间只有一个刷新”靠 fetching 标记和等待队列保证，
+//     正在请求 token 时到达的请求进入 pending，由同一个回调统一唤醒
+//   - 共享数据是 Token 的唯一来源，本地字段只是最近一次读取的副本
+//   - 刷新租约保证所有 worker VM 中同一时间只有一个在请求 token 服务
 type TokenManager struct {
-	token        string       // 当前有效的 Token
-	tokenMutex   sync.RWMutex // 读写锁：允许多读单写
-	refreshMutex sync.Mutex   // 互斥锁：确保同一时间只有一个在刷新
+	token            string              // 当前有效的 Token
+	tokenType        string              // Token 类型，如 Bearer
+	values           map[string]string   // 随 Token 一起提取的其他值，与 Token 一起缓存和失效
+	expiresAt        time.Time           // Token 过期时间，零值表示未知（不主动刷新）
+	issuedAt         time.Time           // Token 获取时间，用于限制提前刷新的时间
+	staleAt          time.Time           // Token 被上游拒绝的时间，零值表示未被拒绝
+	sharedCas        uint32              // 本地副本对应的共享数据版本
+	sharedTokenKey   string              // 共享数据中 Token 的键
+	sharedLeaseKey   string              // 共享数据中刷新租约的键
+	sharedBreakerKey string              // 共享数据中熔断器状态的键
+	fetching         bool                // 本 VM 是否有 token 请求正在进行
+	fetchGen         uint64              // token 请求的代数，用于忽略已放弃请求的回调
+	fetchDeadline    time.Time           // 正在进行的 token 请求最迟完成时间
+	fetchConfig      config.SimpleConfig // 正在进行的 token 请求使用的配置
+	fetchFailures    int                 // 本 VM 连续失败的 token 请求次数
+	refreshRetryAt   time.Time           // token 请求失败后，下一次主动刷新的最早时间
+	lastFetchFailed  bool                // 本 VM 最近一次 token 请求是否失败，用于 stale_if_error
+	pending          []*tokenWaiter      // 等待本 VM token 请求完成的请求
+	waiters          []*tokenWaiter      // 等待其他 VM 刷新 Token 的请求
+	tokenMutex       sync.RWMutex        // 读写锁：允许多读单写
 }
 
-// GetToken 获取当前 Token
+// GetToken 获取当前 Token，已过期或被上游拒绝的 Token 视为不存在
 // ✅ 读锁：允许多个 Goroutine 并发读取，无阻塞
 func (tm *TokenManager) GetToken() string {
+	tm.syncFromShared()
+
 	tm.tokenMutex.RLock()
 	defer tm.tokenMutex.RUnlock()
+	if !tm.staleSince(time.Now()).IsZero() {
+		return ""
+	}
 	return tm.token
 }
 
+// GetTokenType 获取当前 Token 类型
+func (tm *TokenManager) GetTokenType() string {
+	tm.tokenMutex.RLock()
+	defer tm.tokenMutex.RUnlock()
+	return tm.tokenType
+}
+
+// GetValues 获取随 Token 一起提取的其他值
+func (tm *TokenManager) GetValues() map[string]string {
+	tm.tokenMutex.RLock()
+	defer tm.tokenMutex.RUnlock()
+	values := make(map[string]string, len(tm.values))
+	for k, v := range tm.values {
+		values[k] = v
+	}
+	return values
+}
+
 // ClearToken 清空Token（使用写锁）
 // ✅ 这个方法是关键！让外部能安全地清空Token
 func (tm *TokenManager) ClearToken() {
 	tm.tokenMutex.Lock()
 	defer tm.tokenMutex.Unlock()
 	tm.token = ""
+	tm.tokenType = ""
+	tm.values = nil
+	tm.expiresAt = time.Time{}
+	tm.staleAt = time.Time{}
+	if err := storeSharedToken(tm.sharedTokenKey, sharedToken{}); err != nil {
+		log.Warnf("清空共享 token 失败: %v", err)
+	}
 	log.Infof("✅ Token clear")
 }
 
-func (tm *TokenManager) FetchToken(config config.SimpleConfig) types.Action {
-	// 🔐 第一层锁：防惊群
-	tm.refreshMutex.Lock()
-	defer tm.refreshMutex.Unlock()
+// InvalidateToken 标记 staleToken 失效；如果其他 VM 已经换上新 Token 则保持不变
+// keepStale 为 true 时保留旧 Token 供 stale_while_revalidate / stale_if_error 使用
+func (tm *TokenManager) InvalidateToken(staleToken string, keepStale bool) {
+	if err := invalidateSharedToken(tm.sharedTokenKey, staleToken, keepStale); err != nil {
+		log.Warnf("清空共享 token 失败: %v", err)
+	}
+
+	tm.tokenMutex.Lock()
+	if tm.token == staleToken && keepStale {
+		if tm.staleAt.IsZero() {
+			tm.staleAt = time.Now()
+		}
+	} else if tm.token == staleToken {
+		tm.token = ""
+		tm.tokenType = ""
+		tm.values = nil
+		tm.expiresAt = time.Time{}
+	}
+	tm.tokenMutex.Unlock()
+	log.Infof("✅ Token invalidated")
+}
+
+// syncFromShared 共享数据有更新时刷新本地副本
+func (tm *TokenManager) syncFromShared() {
+	entry, cas, err := loadSharedToken(tm.sharedTokenKey)
+	if err != nil {
+		log.Debugf("读取共享 token 失败，使用本地副本: %v", err)
+		return
+	}
+
+	tm.tokenMutex.Lock()
+	defer tm.tokenMutex.Unlock()
+	if cas == tm.sharedCas {
+		return
+	}
+	tm.token = entry.Token
+	tm.tokenType = entry.TokenType
+	tm.values = entry.Values
+	tm.expiresAt = fromUnixMilli(entry.ExpiresAt)
+	tm.issuedAt = fromUnixMilli(entry.IssuedAt)
+	tm.staleAt = fromUnixMilli(entry.StaleAt)
+	tm.sharedCas = cas
+}
+
+// RefreshIfNeeded 在 Token 即将过期时主动刷新，由插件 tick 周期调用
+// 只有抢到刷新租约的 VM 会发起请求，其他 VM 通过共享数据拿到新 Token
+func (tm *TokenManager) RefreshIfNeeded(config config.SimpleConfig) {
+	tm.syncFromShared()
 
-	// 🚪 再次检查 token 是否已存在（别人可能已经刷新好了）
 	tm.tokenMutex.RLock()
-	if tm.token != "" {
+	token, issuedAt, expiresAt := tm.token, tm.issuedAt, tm.expiresAt
+	tm.tokenMutex.RUnlock()
+
+	if token == "" || expiresAt.IsZero() || tm.fetching {
+		return
+	}
+	if tm.breakerRejects(config.TokenConfig.CircuitBreaker) || time.Now().Before(tm.refreshRetryAt) {
+		return
+	}
+	skew := refreshSkew(time.Duration(config.TokenConfig.RefreshSkew)*time.Second, issuedAt, expiresAt)
+	if time.Until(expiresAt) > skew {
+		return
+	}
+
+	if tm.startFetch(config) {
+		log.Infof("Token 将于 %s 过期，开始主动刷新", expiresAt.Format(time.RFC3339))
+	}
+}
+
+// RefreshToken 在 staleToken 被上游判定失效后获取新 Token 并回调
+// 其他 VM 已刷新时直接复用，否则抢租约刷新或等待刷新完成；
+// deadline 不为零值时最多等到 deadline，到期以 ErrDeadlineExceeded 回调
+func (tm *TokenManager) RefreshToken(ctx wrapper.HttpContext, config config.SimpleConfig, staleToken string, deadline time.Time, callback func(string, error)) {
+	tm.InvalidateToken(staleToken, keepsStaleToken(config.TokenConfig))
+	if token := tm.GetToken(); token != "" {
+		log.Infof("✅ 其他 VM 已刷新 token，直接复用")
+		callback(token, nil)
+		return
+	}
+	tm.requestOrWait(ctx, config, deadline, callback)
+}
+
+func (tm *TokenManager) FetchToken(ctx wrapper.HttpContext, config config.SimpleConfig) types.Action {
+	stripDegradedHeader(config.TokenConfig)
+
+	// 没有请求体时不会进入请求体阶段，请求体中的 token 无法注入
+	if hasBodyInjection(config.TokenConfig) && !wrapper.HasRequestBody() {
+		if !allowWithoutToken(config.TokenConfig, failureNoRequestBody) {
+			tm.denyRequest(config, failureNoRequestBody, nil)
+			return types.ActionPause
+		}
+		log.Warnf("请求没有请求体，按 on_token_failure 放行，请求体中不会注入 token")
+	}
+
+	// 🚪 检查 token 是否已存在（别人可能已经刷新好了），已过期的 token 不复用
+	if token := tm.GetToken(); token != "" {
 		log.Infof("✅ Token 已存在，直接复用")
-		tm.tokenMutex.RUnlock()
-		tm.InjectToken(config, nil)
+		ctx.SetContext(UsedTokenKey, token)
+		tm.InjectToken(config, token)
+		return types.ActionContinue
+	}
+
+	// ♻️ Token 已过期或被上游拒绝，在 stale_while_revalidate 窗口内继续使用旧 Token，后台刷新
+	refreshFailing := tm.lastFetchFailed || tm.breakerRejects(config.TokenConfig.CircuitBreaker)
+	if token := tm.GetStaleToken(config.TokenConfig, refreshFailing); token != "" {
+		log.Infof("✅ 使用旧 Token，后台刷新")
+		tm.revalidate(config)
+		ctx.SetContext(UsedTokenKey, token)
+		tm.InjectToken(config, token)
 		return types.ActionContinue
 	}
-	tm.tokenMutex.RUnlock()
 
 	// 🌐 现在开始获取 token（异步）
-	tm.RequestTokenAsync(config, func(token string, err error) {
-		if err != nil {
-			log.Errorf("❌ 获取 token 失败: %v", err)
-			// ❌ 不能在这里 return，要通知 Envoy
-			tm.sendResponse(500, "token.fetch.failed", nil, nil)
+	// 回调可能在 requestOrWait 返回前同步执行（如请求无法发出后改用旧 Token），此时不能 Resume
+	inline, resumed := true, false
+	tm.requestOrWait(ctx, config, time.Time{}, func(token string, err error) {
+		if errors.Is(err, ErrTooManyPending) {
+			log.Warnf("❌ 等待 token 的请求过多，拒绝当前请求")
+			tm.sendResponse(503, "token.pending.overflow", nil, nil)
 			return
 		}
 
-		if token == "" {
-			log.Errorf("❌ 获取到空 token")
-			tm.sendResponse(500, "token.empty", nil, nil)
-			return
+		if err != nil {
+			if stale := tm.GetStaleToken(config.TokenConfig, true); stale != "" {
+				log.Warnf("获取 token 失败，在 stale_if_error 窗口内使用旧 Token: %v", err)
+				token = stale
+				err = nil
+			}
 		}
 
-		// ✅ 成功获取 token
-		log.Infof("✅ 成功获取 token，长度: %d", len(token))
-		tm.InjectToken(config, nil) // 注入到当前请求
+		if err != nil || token == "" {
+			reason := failureReason(err)
+			if !allowWithoutToken(config.TokenConfig, reason) {
+				tm.denyRequest(config, reason, err)
+				return
+			}
+			log.Warnf("❌ 获取 token 失败（%s），按 on_token_failure 不带 token 放行: %v", reason, err)
+		} else {
+			// ✅ 成功获取 token
+			log.Infof("✅ 成功获取 token，长度: %d", len(token))
+			ctx.SetContext(UsedTokenKey, token)
+			tm.InjectToken(config, token) // 注入到当前请求
+		}
+
+		if inline {
+			resumed = true
+			return
+		}
 		log.Debugf("恢复原始请求处理")
 
 		// 🎉 恢复被暂停的请求
 		proxywasm.ResumeHttpRequest()
 	})
+	inline = false
+	if resumed {
+		return types.ActionContinue
+	}
 
 	// ⏸️ 暂停当前请求，等待 token 获取完成
 	log.Debugf("暂停请求处理，等待 token 获取完成")
 	return types.HeaderStopAllIterationAndWatermark
 }
 
-func (tm *TokenManager) RequestTokenAsync(config config.SimpleConfig, callback func(string, error)) {
+// requestTokenOnce 向 token 服务发起一次请求，重试由 RequestTokenAsync 负责
+func (tm *TokenManager) requestTokenOnce(config config.SimpleConfig, callback func(string, error)) {
+	if isClientCredentials(config.TokenConfig) {
+		tm.requestClientCredentialsToken(config, callback)
+		return
+	}
+
 	// 构建请求...
 	formData := make(url.Values)
 	for k, v := range config.TokenConfig.Credential.FormFields {
@@ -120,86 +301,173 @@ func (tm *TokenManager) RequestTokenAsync(config config.SimpleConfig, callback f
 	err := config.TokenService.Client.Call(
 		"POST", config.TokenConfig.TokenPath, headers, body,
 		func(statusCode int, h http.Header, body []byte) {
-			if statusCode == 200 {
-				token, err := tm.extractTokenFromResponse(body, config.TokenConfig.TokenExtraction.ResponsePath)
-				if err == nil && token != "" {
-					tm.tokenMutex.Lock()
-					tm.token = token
-					tm.tokenMutex.Unlock()
-					callback(token, nil)
+			if err := checkCallResult(h); err != nil {
+				callback("", err)
+				return
+			}
+			if err := checkTokenResponse(statusCode, h, body, config.TokenConfig); err != nil {
+				callback("", err)
+				return
+			}
+			token, err := tm.extractValue(h, body, config.TokenConfig.TokenExtraction.ValueExtraction, "datas")
+			if err == nil && token != "" {
+				values, err := tm.extractValues(h, body, config.TokenConfig.TokenExtraction.Values)
+				if err != nil {
+					callback("", fmt.Errorf("extract failed: %v", err))
 					return
 				}
+				expiresIn := extractExpiresIn(body, config.TokenConfig.TokenExtraction)
+				tm.setToken(token, "", resolveExpiry(expiresIn, token, config.TokenConfig.TokenExtraction), values)
+				callback(token, nil)
+				return
+			}
+			callback("", fmt.Errorf("extract failed: %v", err))
+		},
+		config.TokenConfig.Timeout,
+	)
+
+	if err != nil {
+		callback("", dispatchFailed(err))
+	}
+}
+
+// requestClientCredentialsToken 使用 OAuth2 client_credentials 模式获取 Token
+func (tm *TokenManager) requestClientCredentialsToken(config config.SimpleConfig, callback func(string, error)) {
+	headers, body := buildClientCredentialsRequest(config.TokenConfig.Credential)
+
+	err := config.TokenService.Client.Call(
+		"POST", config.TokenConfig.TokenPath, headers, body,
+		func(statusCode int, h http.Header, body []byte) {
+			if err := checkCallResult(h); err != nil {
+				callback("", err)
+				return
+			}
+			if err := checkTokenResponse(statusCode, h, body, config.TokenConfig); err != nil {
+				callback("", err)
+				return
+			}
+			token, err := parseOAuth2Response(body)
+			if err != nil {
+				callback("", err)
+				return
+			}
+			values, err := tm.extractValues(h, body, config.TokenConfig.TokenExtraction.Values)
+			if err != nil {
 				callback("", fmt.Errorf("extract failed: %v", err))
 				return
 			}
-			callback("", fmt.Errorf("http %d", statusCode))
+			log.Debugf("OAuth2 token 获取成功，token_type: %s，expires_in: %d", token.TokenType, token.ExpiresIn)
+			tm.setToken(token.AccessToken, token.TokenType, resolveExpiry(token.ExpiresIn, token.AccessToken, config.TokenConfig.TokenExtraction), values)
+			callback(token.AccessToken, nil)
 		},
 		config.TokenConfig.Timeout,
 	)
 
 	if err != nil {
-		callback("", fmt.Errorf("call failed: %w", err))
+		callback("", dispatchFailed(err))
 	}
 }
 
-// extractTokenFromResponse 从响应中提取 Token
-func (tm *TokenManager) extractTokenFromResponse(responseBody []byte, responsePath string) (string, error) {
-	if responsePath == "" {
-		responsePath = "datas"
+// setToken 更新当前 Token、过期时间及其他值（使用写锁），并同步到共享数据
+func (tm *TokenManager) setToken(token string, tokenType string, expiresAt time.Time, values map[string]string) {
+	if tokenType == "" {
+		tokenType = defaultTokenType
 	}
+	tm.tokenMutex.Lock()
+	defer tm.tokenMutex.Unlock()
+	tm.token = token
+	tm.tokenType = tokenType
+	tm.values = values
+	tm.expiresAt = expiresAt
+	tm.issuedAt = time.Now()
+	tm.staleAt = time.Time{}
+
+	err := storeSharedToken(tm.sharedTokenKey, sharedToken{
+		Token:     token,
+		TokenType: tokenType,
+		ExpiresAt: unixMilli(expiresAt),
+		IssuedAt:  unixMilli(tm.issuedAt),
+		Values:    values,
+	})
+	if err != nil {
+		log.Warnf("写入共享 token 失败: %v", err)
+	}
+}
 
-	var response map[string]interface{}
-	if err := json.Unmarshal(responseBody, &response); err != nil {
-		return "", fmt.Errorf("解析 JSON 失败: %v", err)
+// extractValues 提取随 Token 一起下发的其他值，任意一个缺失都视为失败
+func (tm *TokenManager) extractValues(headers http.Header, responseBody []byte, extractions map[string]config.ValueExtraction) (map[string]string, error) {
+	if len(extractions) == 0 {
+		return nil, nil
+	}
+	values := make(map[string]string, len(extractions))
+	for name, extraction := range extractions {
+		value, err := tm.extractValue(headers, responseBody, extraction, "")
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", name, err)
+		}
+		values[name] = value
 	}
+	return values, nil
+}
 
-	current := response
-	fields := strings.Split(responsePath, ".")
-	for i, field := range fields {
-		if i == len(fields)-1 {
-			if token, ok := current[field].(string); ok && token != "" {
-				return token, nil
+// extractValue 按 source 从响应头、Set-Cookie 或响应体中提取值
+func (tm *TokenManager) extractValue(headers http.Header, responseBody []byte, extraction config.ValueExtraction, defaultPath string) (string, error) {
+	switch extraction.Source {
+	case config.TokenSourceHeader:
+		if value := headers.Get(extraction.HeaderName); value != "" {
+			return value, nil
+		}
+		return "", fmt.Errorf("响应头 %s 未找到有效值", extraction.HeaderName)
+	case config.TokenSourceCookie:
+		for _, cookie := range (&http.Response{Header: headers}).Cookies() {
+			if cookie.Name == extraction.CookieName && cookie.Value != "" {
+				return cookie.Value, nil
 			}
-			return "", fmt.Errorf("路径 %s 未找到有效 Token", responsePath)
 		}
-		if next, ok := current[field].(map[string]interface{}); ok {
-			current = next
-		} else {
-			return "", fmt.Errorf("路径中断于: %s", field)
+		return "", fmt.Errorf("Set-Cookie %s 未找到有效值", extraction.CookieName)
+	default:
+		responsePath := extraction.ResponsePath
+		if responsePath == "" {
+			responsePath = defaultPath
 		}
+		return tm.extractFromBody(responseBody, responsePath)
 	}
-	return "", fmt.Errorf("未找到 Token")
 }
 
-func (tm *TokenManager) InjectToken(config config.SimpleConfig, body []byte) {
-	log.Infof("开始注入token到请求中")
-
-	// 从上下文中获取token
-	token := tm.GetToken()
-	if token == "" {
-		return
+// extractFromBody 按 gjson 路径从 JSON 响应体中提取值，数字会转换为字符串
+func (tm *TokenManager) extractFromBody(responseBody []byte, responsePath string) (string, error) {
+	if !gjson.ValidBytes(responseBody) {
+		return "", fmt.Errorf("解析 JSON 失败")
 	}
-	// 根据配置注入token
-	for _, injection := range config.TokenConfig.TokenInjection {
-		log.Debugf("根据配置注入token，类型: %s，键: %s，格式: %s", injection.Type, injection.Key, injection.Format)
-
-		// 替换格式中的{token}占位符
-		formattedValue := strings.Replace(injection.Format, "{token}", token, -1)
-
-		switch injection.Type {
-		case "header":
-			log.Debugf("将token注入到请求头: %s", injection.Key)
-			_ = proxywasm.AddHttpRequestHeader(injection.Key, formattedValue)
-		case "form_body", "form":
-			log.Debugf("将token注入到表单体，键: %s", injection.Key)
-			modifiedBody := tm.addTokenToFormBody(body, formattedValue, injection.Key)
-			_ = proxywasm.ReplaceHttpRequestBody(modifiedBody)
-		default:
-			log.Warnf("未知的注入类型: %s", injection.Type)
+
+	result := gjson.GetBytes(responseBody, responsePath)
+	switch result.Type {
+	case gjson.String, gjson.Number:
+		if value := result.String(); value != "" {
+			return value, nil
+		}
+	case gjson.Null:
+		if !result.Exists() {
+			return "", fmt.Errorf("路径 %s 不存在", responsePath)
 		}
+	default:
+		return "", fmt.Errorf("路径 %s 的值不是字符串或数字: %s", responsePath, result.Type)
 	}
+	return "", fmt.Errorf("路径 %s 未找到有效值", responsePath)
+}
 
-	log.Infof("Token注入完成")
+// placeholderReplacer 构建注入格式的占位符替换器
+func (tm *TokenManager) placeholderReplacer(token string) *strings.Replacer {
+	values := tm.GetValues()
+	pairs := make([]string, 0, 2*len(values)+4)
+	for name, value := range values {
+		pairs = append(pairs, "{"+name+"}", value)
+	}
+	pairs = append(pairs,
+		"{"+config.PlaceholderToken+"}", token,
+		"{"+config.PlaceholderTokenType+"}", tm.GetTokenType(),
+	)
+	return strings.NewReplacer(pairs...)
 }
 
 // addTokenToFormBody 将token添加到表单数据中
@@ -228,6 +496,44 @@ func (tm *TokenManager) addTokenToFormBody(originalBody []byte, token string, to
 	return result
 }
 
+// fetchFailedResponse 获取 token 失败时的内置响应，token 服务返回了错误信息时带给客户端
+func fetchFailedResponse(err error) config.ErrorResponse {
+	response := config.ErrorResponse{StatusCode: 500}
+	var serviceErr *TokenServiceError
+	if errors.As(err, &serviceErr) && serviceErr.Message != "" {
+		response.Headers = map[string]string{"content-type": "text/plain; charset=utf-8"}
+		response.Body = "Failed to fetch token: " + serviceErr.Message
+	}
+	return response
+}
+
+// denyRequest 无法获取 Token 且不放行时直接返回错误响应
+func (tm *TokenManager) denyRequest(cfg config.SimpleConfig, reason string, err error) {
+	switch reason {
+	case failureCircuitOpen:
+		log.Warnf("❌ token 服务熔断中，直接返回")
+		tm.SendCircuitOpenResponse(cfg)
+	case failureNoRequestBody:
+		log.Errorf("❌ 请求没有请求体，无法按 token_injection 注入 token")
+		SendErrorResponse(cfg.TokenConfig, config.ErrorKindFetchFailed, failureNoRequestBody,
+			"request has no body to inject the token into", config.ErrorResponse{StatusCode: 400})
+	case failureEmptyToken:
+		log.Errorf("❌ 获取到空 token")
+		sendKindResponse(cfg.TokenConfig, config.ErrorKindEmptyToken, failureEmptyToken, "empty token")
+	default:
+		log.Errorf("❌ 获取 token 失败: %v", err)
+		// ❌ 不能在这里 return，要通知 Envoy
+		SendErrorResponse(cfg.TokenConfig, config.ErrorKindFetchFailed, failureFetchFailed, ErrorReason(err), fetchFailedResponse(err))
+	}
+}
+
+// SendCircuitOpenResponse token 服务熔断期间返回 circuit_breaker.open_* 配置的响应
+func (tm *TokenManager) SendCircuitOpenResponse(config config.SimpleConfig) error {
+	breaker := config.TokenConfig.CircuitBreaker
+	headers := http.Header{"content-type": []string{"text/plain; charset=utf-8"}}
+	return tm.sendResponse(breaker.OpenStatusCode, failureCircuitOpen, headers, []byte(breaker.OpenBody))
+}
+
 func (tm *TokenManager) sendResponse(statusCode uint32, statusCodeDetailData string, headers http.Header, body []byte) error {
 	var ret [][2]string
 	for k, vs := range headers {
@@ -239,68 +545,25 @@ func (tm *TokenManager) sendResponse(statusCode uint32, statusCodeDetailData str
 	return proxywasm.SendHttpResponseWithDetail(statusCode, statusCodeDetailData, ret, body, -1)
 }
 
-// IsTokenInvalid 判断响应是否表示 token 无效
-func (tm *TokenManager) IsTokenInvalid(responseBody []byte, config config.SimpleConfig) bool {
-	log.Debugf("使用表达式检查token是否无效，条件: %s，响应体: %s",
-		config.TokenConfig.InvalidTokenCondition, string(responseBody))
+// IsTokenInvalid 根据响应状态码、响应头和 JSON 响应体判断 token 是否无效
+// responseBody 为 nil 时只能判断不引用响应体的条件，引用了响应体的条件视为有效
+func (tm *TokenManager) IsTokenInvalid(status int, headers http.Header, responseBody []byte, config config.SimpleConfig) bool {
+	log.Debugf("使用表达式检查token是否无效，条件: %s，响应体长度: %d",
+		config.TokenConfig.InvalidTokenCondition, len(responseBody))
 
 	// 如果没有配置条件，使用默认方法
-	if config.TokenConfig.InvalidTokenCondition == "" {
+	program := config.TokenConfig.InvalidTokenProgram
+	if program == nil {
 		return false
 	}
 
-	// 解析响应 JSON
-	var response map[string]interface{}
-	if err := json.Unmarshal(responseBody, &response); err != nil {
-		log.Errorf("解析响应JSON失败: %v", err)
+	if responseBody == nil && program.NeedsBody() {
 		return false
 	}
 
-	// 构建表达式执行环境
-	env := make(map[string]interface{})
-
-	// 1. 注入自定义函数（如 contains）
-	env["contains"] = func(a, b interface{}) bool {
-		s, ok1 := a.(string)
-		sub, ok2 := b.(string)
-		return ok1 && ok2 && strings.Contains(s, sub)
-	}
-
-	// Add the has function to check if a field exists
-	env["has"] = func(mapVar map[string]interface{}, key string) bool {
-		_, exists := mapVar[key]
-		return exists
-	}
-
-	// 2. 注入顶层字段，支持直接写 code != 0
-	for k, v := range response {
-		// 避免覆盖自定义函数（如 contains）
-		if _, exists := env[k]; !exists {
-			env[k] = v
-		}
-	}
-
-	// 3. 注入整个 response，支持嵌套访问（如 result.succ）
-	env["response"] = response
-
-	// 编译表达式
-	program, err := expr.Compile(config.TokenConfig.InvalidTokenCondition, expr.Env(env))
+	result, err := program.Eval(program.NewEnv(status, headers, responseBody))
 	if err != nil {
-		log.Errorf("编译表达式失败: %v", err)
-		return false
-	}
-
-	// 执行表达式
-	output, err := expr.Run(program, env)
-	if err != nil {
-		log.Errorf("执行表达式失败: %v", err)
-		return false
-	}
-
-	// 检查返回值是否为布尔类型
-	result, ok := output.(bool)
-	if !ok {
-		log.Warnf("表达式返回值不是布尔类型: %T, 值: %v", output, output)
+		log.Errorf("%v", err)
 		return false
 	}
 
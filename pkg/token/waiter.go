@@ -0,0 +1,198 @@
+package token
+
+import (
+	"bst-auth/pkg/config"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/higress-group/wasm-go/pkg/log"
+	"github.com/higress-group/wasm-go/pkg/wrapper"
+)
+
+// UsedTokenKey 请求上下文中记录本次注入的 Token，用于失效时精确清理
+const UsedTokenKey = "token-used"
+
+// ErrTooManyPending 等待 Token 的请求数达到 max_pending_requests 上限
+var ErrTooManyPending = errors.New("too many requests waiting for token")
+
+// ErrDeadlineExceeded 调用方给定的截止时间前没有拿到 Token
+var ErrDeadlineExceeded = errors.New("deadline exceeded while waiting for token")
+
+// tokenWaiter 等待 Token 的暂停请求
+type tokenWaiter struct {
+	ctx      wrapper.HttpContext
+	config   config.SimpleConfig
+	deadline time.Time // 等待超时时间，不晚于 limit
+	limit    time.Time // 调用方给定的截止时间，零值表示不限制
+	callback func(string, error)
+}
+
+// waitTimeout 请求最多等待 token 请求（含重试）完成的时长
+func waitTimeout(config config.SimpleConfig) time.Duration {
+	return fetchBudget(config.TokenConfig) + minLeaseMillis*time.Millisecond
+}
+
+// requestOrWait 在没有可用 Token 时调用：
+//   - token 服务熔断中时直接返回 ErrCircuitOpen
+//   - 本 VM 已有 token 请求在进行时加入 pending，由该请求的回调统一唤醒
+//   - 抢到刷新租约则发起 token 请求，当前请求作为第一个 pending
+//   - 否则挂起等待持有租约的 VM 把新 Token 写入共享数据
+//
+// limit 不为零值时，到期仍未拿到 Token 的请求以 ErrDeadlineExceeded 回调，token 请求本身继续进行
+func (tm *TokenManager) requestOrWait(ctx wrapper.HttpContext, config config.SimpleConfig, limit time.Time, callback func(string, error)) {
+	if len(tm.pending)+len(tm.waiters) >= config.TokenConfig.MaxPendingRequests {
+		callback("", ErrTooManyPending)
+		return
+	}
+	if tm.breakerRejects(config.TokenConfig.CircuitBreaker) {
+		callback("", ErrCircuitOpen)
+		return
+	}
+
+	if !limit.IsZero() && !time.Now().Before(limit) {
+		callback("", ErrDeadlineExceeded)
+		return
+	}
+
+	w := &tokenWaiter{
+		ctx:      ctx,
+		config:   config,
+		deadline: time.Now().Add(waitTimeout(config)),
+		limit:    limit,
+		callback: callback,
+	}
+	if !limit.IsZero() && limit.Before(w.deadline) {
+		w.deadline = limit
+	}
+	if tm.fetching {
+		tm.pending = append(tm.pending, w)
+		log.Debugf("token 请求正在进行，加入等待队列，当前等待数: %d", len(tm.pending))
+		return
+	}
+
+	// 先入队再发起请求：token 请求同步失败时回调会立即唤醒 pending
+	tm.pending = append(tm.pending, w)
+	if tm.startFetch(config) {
+		return
+	}
+	tm.pending = tm.pending[:len(tm.pending)-1]
+
+	log.Debugf("其他 VM 正在刷新 token，等待共享数据更新")
+	tm.waiters = append(tm.waiters, w)
+}
+
+// startFetch 抢到刷新租约后向 token 服务发起请求，完成时统一唤醒 pending 中的请求
+// 未抢到租约返回 false
+func (tm *TokenManager) startFetch(config config.SimpleConfig) bool {
+	if !tryAcquireLease(tm.sharedLeaseKey, fetchBudget(config.TokenConfig)) {
+		return false
+	}
+
+	tm.beginProbe(config.TokenConfig.CircuitBreaker)
+
+	tm.fetchGen++
+	gen := tm.fetchGen
+	tm.fetching = true
+	tm.fetchDeadline = time.Now().Add(waitTimeout(config))
+	tm.fetchConfig = config
+	tm.RequestTokenAsync(config, func(token string, err error) {
+		if gen != tm.fetchGen {
+			log.Debugf("忽略已放弃的 token 请求回调")
+			return
+		}
+		tm.fetching = false
+		tm.lastFetchFailed = err != nil
+		tm.recordRefreshResult(config.TokenConfig.FetchRetry.Backoff, err)
+		releaseLease(tm.sharedLeaseKey)
+		tm.resumePending(token, err)
+	})
+	return true
+}
+
+// resume 切换到等待请求的上下文并回调，切换失败说明请求已不存在，直接丢弃
+func (w *tokenWaiter) resume(token string, err error) {
+	if !ActivateContext(w.ctx) {
+		log.Warnf("无法切换到等待 token 的请求，丢弃该请求")
+		return
+	}
+	w.callback(token, err)
+}
+
+// resumePending 用 token 请求的结果唤醒所有 pending 中的请求
+func (tm *TokenManager) resumePending(token string, err error) {
+	pending := tm.pending
+	tm.pending = nil
+	if len(pending) > 0 {
+		log.Infof("token 请求完成，唤醒 %d 个等待中的请求", len(pending))
+	}
+	for _, w := range pending {
+		w.resume(token, err)
+	}
+}
+
+// ProcessWaiters 由插件 tick 周期调用：
+//   - 发起 token 请求的 HTTP 上下文被销毁时回调不会触发，超时后放弃并重新发起，
+//     token 服务熔断中时改为以 ErrCircuitOpen 唤醒等待的请求
+//   - 给定了截止时间的请求到期后不再等待 token 请求完成
+//   - 检查共享数据中是否已有其他 VM 刷新的 Token；
+//     刷新租约空闲（持有者失败或异常退出）时，由等待的请求接手刷新
+func (tm *TokenManager) ProcessWaiters() {
+	now := time.Now()
+	if tm.fetching && now.After(tm.fetchDeadline) {
+		log.Warnf("token 请求超时未回调，放弃并重新发起")
+		tm.fetchGen++
+		tm.fetching = false
+		releaseLease(tm.sharedLeaseKey)
+		switch {
+		case len(tm.pending) == 0:
+		case tm.breakerRejects(tm.fetchConfig.TokenConfig.CircuitBreaker):
+			// 熔断冷却期间不重新发起，否则 beginProbe 会提前进入 half_open
+			tm.resumePending("", ErrCircuitOpen)
+		case !tm.startFetch(tm.fetchConfig):
+			tm.waiters = append(tm.waiters, tm.pending...)
+			tm.pending = nil
+		}
+	}
+
+	tm.expirePending(now)
+
+	if len(tm.waiters) == 0 {
+		return
+	}
+
+	waiters := tm.waiters
+	tm.waiters = nil
+	token := tm.GetToken()
+	for _, w := range waiters {
+		switch {
+		case token != "":
+			w.resume(token, nil)
+		case !w.limit.IsZero() && !now.Before(w.limit):
+			w.resume("", ErrDeadlineExceeded)
+		case leaseAvailable(tm.sharedLeaseKey):
+			tm.requestOrWait(w.ctx, w.config, w.limit, w.callback)
+		case now.After(w.deadline):
+			w.resume("", fmt.Errorf("timed out waiting for token refresh"))
+		default:
+			tm.waiters = append(tm.waiters, w)
+		}
+	}
+}
+
+// expirePending 把截止时间已到的请求移出 pending 并以 ErrDeadlineExceeded 回调
+func (tm *TokenManager) expirePending(now time.Time) {
+	var expired []*tokenWaiter
+	kept := tm.pending[:0]
+	for _, w := range tm.pending {
+		if !w.limit.IsZero() && !now.Before(w.limit) {
+			expired = append(expired, w)
+			continue
+		}
+		kept = append(kept, w)
+	}
+	tm.pending = kept
+	for _, w := range expired {
+		w.resume("", ErrDeadlineExceeded)
+	}
+}
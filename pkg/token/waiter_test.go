@@ -0,0 +1,71 @@
+package token
+
+import (
+	"bst-auth/pkg/config"
+	"errors"
+	"testing"
+	"time"
+)
+
+// newTestWaiter 创建一个记录回调结果的等待请求
+func newTestWaiter(limit time.Time, results map[string]error, name string) *tokenWaiter {
+	return &tokenWaiter{
+		ctx:      &fakeHttpContext{values: map[string]interface{}{contextIDKey: uint32(1)}},
+		deadline: time.Now().Add(time.Minute),
+		limit:    limit,
+		callback: func(token string, err error) { results[name] = err },
+	}
+}
+
+func TestRequestOrWaitPastLimit(t *testing.T) {
+	tm := &TokenManager{}
+	cfg := config.SimpleConfig{TokenConfig: config.TokenConfig{MaxPendingRequests: 10}}
+
+	var got error
+	called := false
+	tm.requestOrWait(nil, cfg, time.Now().Add(-time.Millisecond), func(token string, err error) {
+		called, got = true, err
+	})
+	if !called || !errors.Is(got, ErrDeadlineExceeded) {
+		t.Fatalf("callback called = %v, err = %v, want ErrDeadlineExceeded", called, got)
+	}
+	if len(tm.pending)+len(tm.waiters) != 0 {
+		t.Fatalf("request was queued after its deadline")
+	}
+}
+
+func TestExpirePending(t *testing.T) {
+	now := time.Now()
+	results := make(map[string]error)
+	tm := &TokenManager{}
+	tm.pending = []*tokenWaiter{
+		newTestWaiter(time.Time{}, results, "unlimited"),
+		newTestWaiter(now.Add(-time.Millisecond), results, "expired"),
+		newTestWaiter(now.Add(time.Second), results, "in time"),
+		newTestWaiter(now, results, "expires now"),
+	}
+
+	tm.expirePending(now)
+
+	if len(tm.pending) != 2 {
+		t.Fatalf("pending = %d, want 2", len(tm.pending))
+	}
+	for _, name := range []string{"expired", "expires now"} {
+		if err, ok := results[name]; !ok || !errors.Is(err, ErrDeadlineExceeded) {
+			t.Errorf("%s: err = %v (called %v), want ErrDeadlineExceeded", name, err, ok)
+		}
+	}
+	for _, name := range []string{"unlimited", "in time"} {
+		if _, ok := results[name]; ok {
+			t.Errorf("%s: called before its deadline", name)
+		}
+	}
+
+	// 剩下的请求仍由 token 请求完成时唤醒
+	tm.resumePending("new-token", nil)
+	for _, name := range []string{"unlimited", "in time"} {
+		if err, ok := results[name]; !ok || err != nil {
+			t.Errorf("%s: err = %v (called %v), want resumed with token", name, err, ok)
+		}
+	}
+}